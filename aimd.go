@@ -0,0 +1,156 @@
+package bwlimit
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// AIMD configures a Controller that increases a limit additively while
+// latency stays at or below a target, and decreases it multiplicatively
+// when latency rises above it.
+type AIMD struct {
+	Target   time.Duration // latency above which the limit is decreased
+	Min      int64         // lowest limit in bytes/sec, at least 1
+	Max      int64         // highest limit in bytes/sec, at least Min
+	Increase int64         // bytes/sec added each time slice, if zero 1% of Max-Min
+	Decrease float64       // factor to multiply the limit with, if zero 0.5
+	// Probe, if not nil, is called once every time slice to measure the
+	// round-trip time. Samples where it returns an error are ignored.
+	Probe func(ctx context.Context) (time.Duration, error)
+}
+
+// A Controller adjusts the Limit of an Operation every time slice using AIMD.
+//
+// The latency for a time slice is the average time spent in the writes done
+// by the Operation, or the Probe round-trip time if that is higher. Reads are
+// not timed, since time spent in a read is mostly spent waiting for the peer
+// to send, so a Controller for reads needs a Probe. Time slices without
+// writes or probe samples leave the limit unchanged.
+type Controller struct {
+	*Operation              // Operation whose Limit we adjust
+	AIMD                    // settings, not to be changed once running
+	Latency    atomic.Int64 // latency in nanoseconds for the last sampled time slice
+	Increases  atomic.Int64 // number of times the limit was increased
+	Decreases  atomic.Int64 // number of times the limit was decreased
+	samples    *sampler
+	ctx        context.Context // passed to Probe, canceled by Stop
+	cancel     context.CancelFunc
+	stopCh     chan struct{}
+	doneCh     chan struct{}
+}
+
+// A sampler accumulates the time spent in reads or writes.
+type sampler struct {
+	sum atomic.Int64 // nanoseconds
+	n   atomic.Int64
+}
+
+// wrap returns fn timed by the sampler.
+func (s *sampler) wrap(fn func([]byte) (int, error)) func([]byte) (int, error) {
+	return func(b []byte) (n int, err error) {
+		start := time.Now()
+		n, err = fn(b)
+		s.sum.Add(int64(time.Since(start)))
+		s.n.Add(1)
+		return
+	}
+}
+
+// average returns the average time sampled since the last call.
+func (s *sampler) average() (avg time.Duration, ok bool) {
+	if n := s.n.Swap(0); n > 0 {
+		return time.Duration(s.sum.Swap(0) / n), true
+	}
+	return
+}
+
+// NewController starts a Controller adjusting the Limit of op, which
+// is set to aimd.Max if it is not within aimd.Min and aimd.Max.
+//
+// The Controller keeps op's Ticker running until it is stopped by calling
+// Stop, or by stopping op or the Ticker. Only the most recently started
+// Controller for op receives timings from it's writes.
+//
+// The Controller does not keep the Limiter that op belongs to reachable,
+// so it stops if that Limiter is stopped automatically for being unreachable.
+func NewController(op *Operation, aimd AIMD) (c *Controller) {
+	aimd.Min = max(1, aimd.Min)
+	aimd.Max = max(aimd.Min, aimd.Max)
+	if aimd.Increase < 1 {
+		aimd.Increase = max(1, (aimd.Max-aimd.Min)/100)
+	}
+	if aimd.Decrease <= 0 || aimd.Decrease >= 1 {
+		aimd.Decrease = 0.5
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c = &Controller{
+		Operation: op,
+		AIMD:      aimd,
+		samples:   &sampler{},
+		ctx:       ctx,
+		cancel:    cancel,
+		stopCh:    make(chan struct{}),
+		doneCh:    make(chan struct{}),
+	}
+	if limit := op.Limit.Load(); limit < aimd.Min || limit > aimd.Max {
+		op.SetLimit(aimd.Max, 0)
+	}
+	op.sampler.Store(c.samples)
+	go c.run()
+	return
+}
+
+// Stop stops the Controller, leaving the limit as it is.
+// A Probe in progress has it's context canceled.
+func (c *Controller) Stop() {
+	c.cancel()
+	select {
+	case <-c.stopCh:
+	default:
+		close(c.stopCh)
+	}
+	<-c.doneCh
+}
+
+func (c *Controller) run() {
+	defer close(c.doneCh)
+	defer c.Operation.sampler.CompareAndSwap(c.samples, nil)
+	defer c.cancel()
+	for {
+		select {
+		case <-c.Operation.WaitCh():
+		case <-c.Operation.doneCh:
+			return
+		case <-c.stopCh:
+			return
+		}
+		if c.Operation.stopped() {
+			return
+		}
+		latency, ok := c.samples.average()
+		if c.Probe != nil {
+			if rtt, err := c.Probe(c.ctx); err == nil {
+				latency = max(latency, rtt)
+				ok = true
+			}
+		}
+		if ok {
+			c.adjust(latency)
+		}
+	}
+}
+
+// adjust changes the limit based on the latency for the last time slice.
+func (c *Controller) adjust(latency time.Duration) {
+	c.Latency.Store(int64(latency))
+	limit := c.Operation.Limit.Load()
+	if latency > c.Target {
+		limit = int64(float64(limit) * c.Decrease)
+		c.Decreases.Add(1)
+	} else {
+		limit += c.Increase
+		c.Increases.Add(1)
+	}
+	c.Operation.SetLimit(min(c.Max, max(c.Min, limit)), 0)
+}
@@ -0,0 +1,137 @@
+package bwlimit
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestController(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+
+		c := NewController(l.Writes, AIMD{
+			Target:   10 * time.Millisecond,
+			Min:      1000,
+			Max:      100_000,
+			Increase: 1000,
+		})
+		defer c.Stop()
+		if limit := l.Writes.Limit.Load(); limit != 100_000 {
+			t.Fatal(limit)
+		}
+
+		// The link gets slow when the limit is above 20000 bytes/sec.
+		ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+		defer cancel()
+		write := func(b []byte) (int, error) {
+			if l.Writes.Limit.Load() > 20_000 {
+				time.Sleep(20 * time.Millisecond)
+			} else {
+				time.Sleep(time.Millisecond)
+			}
+			return len(b), nil
+		}
+		buf := make([]byte, 100)
+		for ctx.Err() == nil {
+			if _, err := l.Writes.io(write, buf); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if limit := l.Writes.Limit.Load(); limit < 10_000 || limit > 21_000 {
+			t.Error(limit)
+		}
+		if c.Increases.Load() == 0 || c.Decreases.Load() == 0 {
+			t.Error(c.Increases.Load(), c.Decreases.Load())
+		}
+
+		c.Stop()
+		if l.Writes.sampler.Load() != nil {
+			t.Error("sampler not removed")
+		}
+	})
+}
+
+func TestController_Probe(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(5000)
+		defer l.Stop()
+
+		var rtt atomic.Int64
+		rtt.Store(int64(time.Second))
+		c := NewController(l.Reads, AIMD{
+			Target: 100 * time.Millisecond,
+			Min:    100,
+			Max:    10_000,
+			Probe: func(ctx context.Context) (time.Duration, error) {
+				return time.Duration(rtt.Load()), nil
+			},
+		})
+		if limit := l.Reads.Limit.Load(); limit != 5000 {
+			t.Fatal(limit)
+		}
+
+		time.Sleep(2 * time.Second)
+		if limit := l.Reads.Limit.Load(); limit != 100 {
+			t.Error(limit)
+		}
+		if latency := time.Duration(c.Latency.Load()); latency != time.Second {
+			t.Error(latency)
+		}
+
+		rtt.Store(int64(time.Millisecond))
+		time.Sleep(2 * time.Second)
+		// Increase defaults to 1% of Max-Min per slice.
+		if limit := l.Reads.Limit.Load(); limit < 100+19*99 || limit > 100+21*99 {
+			t.Error(limit)
+		}
+
+		// Stopping the Operation stops the Controller.
+		l.Stop()
+		<-c.doneCh
+	})
+}
+
+func TestController_Stop(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+
+		probing := make(chan struct{})
+		c := NewController(l.Reads, AIMD{
+			Max: 10_000,
+			Probe: func(ctx context.Context) (time.Duration, error) {
+				close(probing)
+				<-ctx.Done()
+				return 0, ctx.Err()
+			},
+		})
+		<-probing
+		// Stop cancels the Probe in progress instead of waiting for it.
+		c.Stop()
+
+		// Reads are not timed, since they wait for the peer.
+		c = NewController(l.Reads, AIMD{Max: 10_000})
+		defer c.Stop()
+		read := func(b []byte) (int, error) {
+			time.Sleep(time.Second)
+			return len(b), nil
+		}
+		if _, err := l.Reads.io(read, make([]byte, 100)); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := c.samples.average(); ok {
+			t.Error("read sampled")
+		}
+	})
+}
@@ -0,0 +1,100 @@
+package bwlimit
+
+import (
+	"errors"
+	"math"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const minbuffer = batchsize // smallest socket buffer size we set
+const maxbuffer = 16 << 20  // buffer size set once sizing no longer applies
+
+const (
+	bufferUnsupported = -1 // Conn has no socket buffers to size
+	bufferRestored    = -2 // buffer set to maxbuffer after having been sized
+)
+
+// SetBufferTime makes Conns using this Limiter size the send and receive
+// buffers of their socket to hold d worth of data at the write and read
+// limits, plus the round-trip time if known, so that the peer feels the
+// shaping right away instead of after filling large kernel buffers.
+// Buffers are resized on the next read or write after a limit changes.
+//
+// Setting a socket buffer size permanently disables the kernel's automatic
+// buffer tuning for that socket, and it can't be turned back on. When sizing
+// no longer applies to a buffer that was sized, because the limit is removed
+// or SetBufferTime(0) is called, it is instead set to a large size, which the
+// kernel may cap (on Linux, at net.core.wmem_max and net.core.rmem_max).
+// Buffers that were never sized are left alone, as are Conns without a socket.
+// Pass zero to stop sizing buffers.
+func (l *Limiter) SetBufferTime(d time.Duration) {
+	l.buftime.Store(int64(max(0, d)))
+}
+
+// BufferTime returns the duration set by SetBufferTime.
+func (l *Limiter) BufferTime() time.Duration {
+	return time.Duration(l.buftime.Load())
+}
+
+// sizebuffer makes sure the socket buffer for op is sized for it's limit,
+// which is remembered in sized, or restored to a large size once sizing
+// no longer applies.
+func (c *Conn) sizebuffer(op *Operation, sized *atomic.Int64) {
+	var limit int64
+	d := c.Limiter.buftime.Load()
+	if d > 0 {
+		limit = op.effective()
+	}
+	current := sized.Load()
+	var size int
+	switch {
+	case current == bufferUnsupported:
+		return
+	case limit > 0:
+		if current == limit || !sized.CompareAndSwap(current, limit) {
+			return
+		}
+		if info, err := c.TCPInfo(); err == nil {
+			d += int64(info.RTT)
+		}
+		size = int(min(math.MaxInt32, max(minbuffer, float64(limit)*time.Duration(d).Seconds())))
+	case current > 0:
+		if !sized.CompareAndSwap(current, bufferRestored) {
+			return
+		}
+		size = maxbuffer
+	default:
+		return
+	}
+	if setBuffer(c.Conn, size, op == c.Limiter.Writes) != nil {
+		sized.Store(bufferUnsupported)
+	}
+}
+
+// bufferSetter is implemented by net.TCPConn, net.UDPConn and net.UnixConn.
+type bufferSetter interface {
+	SetReadBuffer(bytes int) error
+	SetWriteBuffer(bytes int) error
+}
+
+// setBuffer sets the send or receive buffer size for the socket
+// underlying conn.
+func setBuffer(conn net.Conn, size int, write bool) error {
+	for {
+		switch v := conn.(type) {
+		case *Conn:
+			conn = v.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = v.NetConn()
+		case bufferSetter:
+			if write {
+				return v.SetWriteBuffer(size)
+			}
+			return v.SetReadBuffer(size)
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
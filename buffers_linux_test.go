@@ -0,0 +1,46 @@
+package bwlimit
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestLimiter_SetBufferTime_linux(t *testing.T) {
+	l := NewLimiter(0, 1_000_000)
+	defer l.Stop()
+	l.SetBufferTime(time.Second / 10)
+	c := bufferConn(t, l)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Linux doubles the requested size. The round-trip time adds
+	// a few bytes on loopback.
+	if size := sndbuf(t, c); size < 2*100_000 || size > 2*101_000 {
+		t.Error(size)
+	}
+
+	// Lifting the limit sets a large buffer, since auto-tuning stays off.
+	l.Writes.Limit.Store(0)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if size := sndbuf(t, c); size <= 2*101_000 {
+		t.Error(size)
+	}
+}
+
+func sndbuf(t *testing.T, c *Conn) (size int) {
+	t.Helper()
+	rc, err := rawConn(c, syscall.ENOTSUP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = rc.Control(func(fd uintptr) {
+		size, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
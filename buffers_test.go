@@ -0,0 +1,119 @@
+package bwlimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// bufferConn dials a TCP loopback connection wrapped by l whose peer
+// echoes everything back.
+func bufferConn(t *testing.T, l *Limiter) *Conn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+	conn, err := l.Wrap(nil).DialContext(t.Context(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn.(*Conn)
+}
+
+func TestLimiter_SetBufferTime(t *testing.T) {
+	l := NewLimiter(1_000_000, 0, 500_000)
+	defer l.Stop()
+	l.SetBufferTime(time.Second / 10)
+	if d := l.BufferTime(); d != time.Second/10 {
+		t.Error(d)
+	}
+	c := bufferConn(t, l)
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	// Writes are limited by Total, reads by their own lower limit.
+	if n := c.sndbuf.Load(); n != 500_000 {
+		t.Error(n)
+	}
+	if n := c.rcvbuf.Load(); n != 500_000 {
+		t.Error(n)
+	}
+
+	l.Reads.Limit.Store(100_000)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.rcvbuf.Load(); n != 100_000 {
+		t.Error(n)
+	}
+	if n := c.sndbuf.Load(); n != 500_000 {
+		t.Error(n)
+	}
+	// Lifting the limits restores large buffers.
+	l.Reads.Limit.Store(0)
+	l.Total.Limit.Store(0)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.rcvbuf.Load(); n != bufferRestored {
+		t.Error(n)
+	}
+	if n := c.sndbuf.Load(); n != bufferRestored {
+		t.Error(n)
+	}
+
+	l.Total.Limit.Store(500_000)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.sndbuf.Load(); n != 500_000 {
+		t.Error(n)
+	}
+	l.SetBufferTime(0)
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.sndbuf.Load(); n != bufferRestored {
+		t.Error(n)
+	}
+}
+
+func TestLimiter_SetBufferTime_notSocket(t *testing.T) {
+	l := NewLimiter(1000)
+	defer l.Stop()
+	l.SetBufferTime(time.Second)
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = io.Copy(c2, c2)
+	}()
+	c := NewConn(c1, l)
+	defer c.Close()
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if n := c.sndbuf.Load(); n != bufferUnsupported {
+		t.Error(n)
+	}
+}
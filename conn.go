@@ -2,17 +2,281 @@ package bwlimit
 
 import (
 	"net"
+	"sync/atomic"
+	"time"
 )
 
 type Conn struct {
-	net.Conn // underlying net.Conn
-	*Limiter // Limiter to use
+	net.Conn    // underlying net.Conn
+	*Limiter    // Limiter to use
+	nonblocking atomic.Bool
+	delayer     atomic.Pointer[delayer]
+	faulted     atomic.Int64                 // bytes read and written, if the Limiter injects faults
+	faultrnd    [2]atomic.Pointer[faultRand] // random sources for injecting faults into reads and writes
+	seq         uint64                       // sequence number from NewConn, seeds faultrnd
+	closeCh     chan struct{}                // if not nil, closed by Close
+	reset       atomic.Bool                  // set when fault injection has reset the Conn
+	created     time.Time
+	read        atomic.Int64
+	written     atomic.Int64
+	delivered   atomic.Int64 // bytes written by the delayer, for Burst
+	throttled   atomic.Int64 // nanoseconds spent waiting for budget
+	active      atomic.Int64 // UnixNano of last read or write
+	closed      atomic.Bool
+	rdeadline   atomic.Int64 // UnixNano of read deadline, zero if none
+	wdeadline   atomic.Int64 // UnixNano of write deadline, zero if none
+	pacing      atomic.Int64 // SO_MAX_PACING_RATE set on the socket, -1 if unsupported
+	rcvbuf      atomic.Int64 // bytes/sec that SO_RCVBUF was sized for, or bufferUnsupported or bufferRestored
+	sndbuf      atomic.Int64 // bytes/sec that SO_SNDBUF was sized for, or bufferUnsupported or bufferRestored
+}
+
+// ConnStats holds the statistics for a single Conn.
+type ConnStats struct {
+	Read       int64         // bytes read
+	Written    int64         // bytes written
+	Throttled  time.Duration // time spent waiting for bandwidth budget
+	Created    time.Time     // when the Conn was created
+	LastActive time.Time     // time of the last read or write, zero if none
+	TCP        TCPInfo       // kernel TCP statistics, zero if not available
+}
+
+// NewConn returns a new Conn wrapping conn that is bandwidth limited by l.
+// The Conn is included in l's active Conns until it is closed.
+func NewConn(conn net.Conn, l *Limiter) (c *Conn) {
+	c = &Conn{
+		Conn:    conn,
+		Limiter: l,
+		created: time.Now(),
+		seq:     l.connseq.Add(1),
+		closeCh: make(chan struct{}),
+	}
+	l.track(c)
+	return
+}
+
+// Stats returns the statistics for the Conn.
+func (c *Conn) Stats() (stats ConnStats) {
+	stats = ConnStats{
+		Read:      c.read.Load(),
+		Written:   c.written.Load(),
+		Throttled: time.Duration(c.throttled.Load()),
+		Created:   c.created,
+	}
+	if active := c.active.Load(); active != 0 {
+		stats.LastActive = time.Unix(0, active)
+	}
+	stats.TCP, _ = c.TCPInfo()
+	return
+}
+
+// stat adds n to counter and updates the last activity time.
+func (c *Conn) stat(counter *atomic.Int64, n int) {
+	if n > 0 {
+		counter.Add(int64(n))
+		c.active.Store(time.Now().UnixNano())
+	}
+}
+
+// SetNonBlocking sets whether Read and Write return ErrWouldThrottle
+// instead of waiting when the bandwidth budget is exhausted.
+func (c *Conn) SetNonBlocking(nonblocking bool) {
+	c.nonblocking.Store(nonblocking)
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) {
-	return c.Limiter.Reads.io(c.Conn.Read, b)
+	return c.do(c.Limiter.Reads, c.reader(), b, !c.nonblocking.Load(), &c.read, &c.rdeadline)
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) {
-	return c.Limiter.Writes.io(c.Conn.Write, b)
+	if d := c.delayed(); d != nil {
+		return c.dodelayed(d, b, !c.nonblocking.Load())
+	}
+	if c.kernelpaced() {
+		return c.dopaced(b)
+	}
+	return c.do(c.Limiter.Writes, c.writer(), b, !c.nonblocking.Load(), &c.written, &c.wdeadline)
+}
+
+// do reads or writes b using op and adds the bytes done to counter.
+// The first op.Burst bytes of the Conn bypass the bandwidth limit,
+// and waiting for budget fails with os.ErrDeadlineExceeded once
+// the deadline passes.
+func (c *Conn) do(op *Operation, fn func([]byte) (int, error), b []byte, block bool, counter, deadline *atomic.Int64) (n int, err error) {
+	t := throttle{
+		block:  block,
+		reader: op.reader,
+		waited: &c.throttled,
+		stream: counter,
+	}
+	if d := deadline.Load(); d != 0 {
+		t.deadline = time.Unix(0, d)
+	}
+	n, err = op.doio(fn, b, &t)
+	c.stat(counter, n)
+	return
+}
+
+// kernelpaced returns true if writes are shaped by the kernel.
+// It makes sure SO_MAX_PACING_RATE on the socket matches Writes.Limit
+// while Limiter.KernelPacing is set, and resets it once it is cleared.
+func (c *Conn) kernelpaced() bool {
+	var rate int64
+	if c.Limiter.KernelPacing.Load() && c.Limiter.Total.Limit.Load() < 1 {
+		rate = max(0, c.Limiter.Writes.Limit.Load())
+	}
+	if current := c.pacing.Load(); current != rate && current != -1 && c.pacing.CompareAndSwap(current, rate) {
+		if setPacingRate(c.Conn, rate) != nil {
+			c.pacing.Store(-1)
+		}
+	}
+	return rate > 0 && c.pacing.Load() == rate
+}
+
+// dopaced writes b without shaping, leaving that to the kernel.
+func (c *Conn) dopaced(b []byte) (n int, err error) {
+	n, err = c.writer()(b)
+	c.Limiter.Writes.account(n)
+	c.stat(&c.written, n)
+	return
+}
+
+// storeDeadline stores t in deadline as UnixNano, or zero if t is zero.
+func storeDeadline(deadline *atomic.Int64, t time.Time) {
+	var d int64
+	if !t.IsZero() {
+		d = t.UnixNano()
+	}
+	deadline.Store(d)
+}
+
+// SetDeadline sets the read and write deadlines of the underlying
+// net.Conn, and makes reads and writes stop waiting for bandwidth
+// budget when they pass.
+func (c *Conn) SetDeadline(t time.Time) error {
+	storeDeadline(&c.rdeadline, t)
+	storeDeadline(&c.wdeadline, t)
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the underlying net.Conn,
+// and makes reads stop waiting for bandwidth budget when it passes.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	storeDeadline(&c.rdeadline, t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying net.Conn,
+// and makes writes stop waiting for bandwidth budget when it passes.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	storeDeadline(&c.wdeadline, t)
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// Close closes the underlying net.Conn. If the Limiter adds latency,
+// it is closed after all written bytes have been delivered, and Close
+// waits for that.
+//
+// The first call to Close passes the Conn statistics to the
+// Limiter's OnClose callback, if set.
+func (c *Conn) Close() error {
+	if !c.closed.Swap(true) {
+		if c.closeCh != nil {
+			close(c.closeCh)
+		}
+		c.Limiter.untrack(c)
+		if fn := c.Limiter.onClose.Load(); fn != nil {
+			(*fn)(c, c.Stats())
+		}
+	}
+	if d := c.delayer.Load(); d != nil {
+		return d.close()
+	}
+	return c.Conn.Close()
+}
+
+// reader returns the function used to read from the underlying net.Conn.
+func (c *Conn) reader() (fn func([]byte) (int, error)) {
+	c.sizebuffer(c.Limiter.Reads, &c.rcvbuf)
+	fn = c.Conn.Read
+	if fs := c.Limiter.faults.Load(); fs != nil {
+		fn = c.inject(fs, fn, false)
+	}
+	return
+}
+
+// writer returns the function used to write to the underlying net.Conn.
+func (c *Conn) writer() (fn func([]byte) (int, error)) {
+	c.sizebuffer(c.Limiter.Writes, &c.sndbuf)
+	fn = c.Conn.Write
+	if fs := c.Limiter.faults.Load(); fs != nil {
+		fn = c.inject(fs, fn, true)
+	}
+	return
+}
+
+// delayed returns the delayer for the Conn, or nil if the Limiter has never
+// added latency to it's writes. Once it has, all following writes go through
+// the same delayer to preserve ordering.
+func (c *Conn) delayed() (d *delayer) {
+	if d = c.delayer.Load(); d == nil && c.Limiter.lat.Load() != nil {
+		c.delayer.CompareAndSwap(nil, &delayer{conn: c.Conn, deliver: c.deliver})
+		d = c.delayer.Load()
+	}
+	return
+}
+
+// dodelayed queues b to be delivered by d after the Limiter's latency.
+// The bandwidth limits apply when the bytes are delivered.
+func (c *Conn) dodelayed(d *delayer, b []byte, block bool) (n int, err error) {
+	var deadline time.Time
+	if dl := c.wdeadline.Load(); dl != 0 {
+		deadline = time.Unix(0, dl)
+	}
+	fn := func(b []byte) (int, error) {
+		return d.write(b, time.Now().Add(c.Limiter.delay()), block, deadline)
+	}
+	if fs := c.Limiter.faults.Load(); fs != nil {
+		fn = c.inject(fs, fn, true)
+	}
+	n, err = fn(b)
+	c.stat(&c.written, n)
+	return
+}
+
+// deliver writes b, which was held back by the delayer, to the
+// underlying net.Conn, waiting for bandwidth budget as needed.
+func (c *Conn) deliver(b []byte) (err error) {
+	c.sizebuffer(c.Limiter.Writes, &c.sndbuf)
+	var n int
+	if c.kernelpaced() {
+		n, err = c.Conn.Write(b)
+		c.Limiter.Writes.account(n)
+	} else {
+		t := throttle{
+			block:  true,
+			waited: &c.throttled,
+			stream: &c.delivered,
+		}
+		n, err = c.Limiter.Writes.doio(c.Conn.Write, b, &t)
+	}
+	c.delivered.Add(int64(n))
+	return
+}
+
+// TryRead is like Read, but if the bandwidth budget is exhausted it returns
+// the number of bytes read so far and ErrWouldThrottle instead of waiting.
+func (c *Conn) TryRead(b []byte) (n int, err error) {
+	return c.do(c.Limiter.Reads, c.reader(), b, false, &c.read, &c.rdeadline)
+}
+
+// TryWrite is like Write, but if the bandwidth budget is exhausted it returns
+// the number of bytes written so far and ErrWouldThrottle instead of waiting.
+func (c *Conn) TryWrite(b []byte) (n int, err error) {
+	if d := c.delayed(); d != nil {
+		return c.dodelayed(d, b, false)
+	}
+	if c.kernelpaced() {
+		return c.dopaced(b)
+	}
+	return c.do(c.Limiter.Writes, c.writer(), b, false, &c.written, &c.wdeadline)
 }
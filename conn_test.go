@@ -0,0 +1,295 @@
+package bwlimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestConn_TryRead_TryWrite(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		conn := &Conn{Conn: c1, Limiter: l}
+		defer conn.Close()
+		go func() {
+			_, _ = io.Copy(c2, c2)
+		}()
+
+		buf := make([]byte, 100)
+		n, err := conn.TryWrite(buf)
+		if n != 10 || !errors.Is(err, ErrWouldThrottle) {
+			t.Fatal(n, err)
+		}
+		n, err = conn.TryRead(buf)
+		if n != 10 || !errors.Is(err, ErrWouldThrottle) {
+			t.Fatal(n, err)
+		}
+		n, err = conn.TryRead(buf)
+		if n != 0 || !errors.Is(err, ErrWouldThrottle) {
+			t.Fatal(n, err)
+		}
+
+		conn.SetNonBlocking(true)
+		if n, err = conn.Write(buf); n != 0 || !errors.Is(err, ErrWouldThrottle) {
+			t.Fatal(n, err)
+		}
+		<-l.WaitCh()
+		if n, err = conn.Write(buf); n != 10 || !errors.Is(err, ErrWouldThrottle) {
+			t.Fatal(n, err)
+		}
+	})
+}
+
+func TestConn_Stats(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		var closed []ConnStats
+		l.SetOnClose(func(c *Conn, stats ConnStats) {
+			closed = append(closed, stats)
+		})
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(c2, c2)
+		}()
+		start := time.Now()
+		conn := NewConn(c1, l)
+		if stats := conn.Stats(); !stats.Created.Equal(start) || !stats.LastActive.IsZero() {
+			t.Error(stats)
+		}
+
+		writeDone := make(chan struct{})
+		go func() {
+			defer close(writeDone)
+			if n, err := conn.Write(make([]byte, 20)); n != 20 || err != nil {
+				t.Error(n, err)
+			}
+		}()
+		if n, err := io.ReadFull(conn, make([]byte, 20)); n != 20 || err != nil {
+			t.Fatal(n, err)
+		}
+		<-writeDone
+		stats := conn.Stats()
+		if stats.Read != 20 || stats.Written != 20 {
+			t.Error(stats)
+		}
+		// 10 bytes per slice, so each direction waited one slice.
+		if stats.Throttled != 2*interval {
+			t.Error(stats.Throttled)
+		}
+		if !stats.LastActive.Equal(start.Add(interval)) {
+			t.Error(stats.LastActive.Sub(start))
+		}
+
+		if err := conn.Close(); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		if len(closed) != 1 || closed[0] != stats {
+			t.Error(closed)
+		}
+	})
+}
+
+func TestConn_Burst(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+		l.Reads.Burst.Store(1000)
+		l.Writes.Burst.Store(1000)
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(c2, c2)
+		}()
+		conn := NewConn(c1, l)
+		defer conn.Close()
+
+		// The first 1000 bytes in each direction are not throttled.
+		now := time.Now()
+		writeDone := make(chan struct{})
+		go func() {
+			defer close(writeDone)
+			if n, err := conn.Write(make([]byte, 1030)); n != 1030 || err != nil {
+				t.Error(n, err)
+			}
+		}()
+		if n, err := io.ReadFull(conn, make([]byte, 1000)); n != 1000 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != 0 {
+			t.Error(elapsed)
+		}
+
+		// After that, the limit applies.
+		if n, err := io.ReadFull(conn, make([]byte, 30)); n != 30 || err != nil {
+			t.Fatal(n, err)
+		}
+		<-writeDone
+		if elapsed := time.Since(now); elapsed != 2*interval {
+			t.Error(elapsed)
+		}
+		if stats := conn.Stats(); stats.Read != 1030 || stats.Written != 1030 {
+			t.Error(stats)
+		}
+		if n := l.Total.count.Load() + l.Total.Count.Load(); n != 2060 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestConn_SetDeadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		conn := NewConn(c1, l)
+		defer conn.Close()
+
+		now := time.Now()
+		if err := conn.SetWriteDeadline(now.Add(time.Second / 4)); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Write(make([]byte, 1000))
+		if n != 30 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != time.Second/4 {
+			t.Error(elapsed)
+		}
+
+		// An expired deadline fails without waiting.
+		if n, err = conn.Write(make([]byte, 1000)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error(n, err)
+		}
+
+		if err = conn.SetDeadline(time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		<-l.WaitCh()
+		if n, err = conn.Write(make([]byte, 10)); n != 10 || err != nil {
+			t.Error(n, err)
+		}
+	})
+}
+
+// loopbackSource returns the address of a TCP loopback listener
+// that writes to connections as fast as it can.
+func loopbackSource(tb testing.TB) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			buf := make([]byte, 256*1024)
+			for {
+				if _, err := conn.Write(buf); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// benchmarkConn_loopback measures reading through a Conn limited to
+// limit bytes/sec from a TCP loopback connection.
+func benchmarkConn_loopback(b *testing.B, limit int64) {
+	address := loopbackSource(b)
+
+	ticker := NewTicker()
+	defer ticker.Stop()
+	l := ticker.NewLimiter(limit)
+	defer l.Stop()
+
+	conn, err := l.Wrap(nil).DialContext(b.Context(), "tcp", address)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 256*1024)
+	b.SetBytes(int64(len(buf)))
+	for b.Loop() {
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConn_loopback_unlimited(b *testing.B) {
+	benchmarkConn_loopback(b, 0)
+}
+
+func BenchmarkConn_loopback_100Gbit(b *testing.B) {
+	benchmarkConn_loopback(b, 100_000_000_000/8)
+}
+
+// TestConn_loopback_overhead checks that a limit above what TCP loopback
+// can do keeps throughput within a few percent of unlimited, by comparing
+// the time spent limiting with the time spent reading. Comparing separate
+// throughput runs instead is too noisy on shared machines.
+func TestConn_loopback_overhead(t *testing.T) {
+	if testing.Short() {
+		t.Skip("measures throughput")
+	}
+	nc, err := net.Dial("tcp", loopbackSource(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	ticker := NewTicker()
+	defer ticker.Stop()
+	l := ticker.NewLimiter(100_000_000_000 / 8)
+	defer l.Stop()
+
+	var reading time.Duration
+	read := func(b []byte) (n int, err error) {
+		start := time.Now()
+		n, err = nc.Read(b)
+		reading += time.Since(start)
+		return
+	}
+	buf := make([]byte, 256*1024)
+	start := time.Now()
+	for time.Since(start) < 500*time.Millisecond {
+		if _, err := l.Reads.io(read, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	elapsed := time.Since(start)
+	limiting := elapsed - reading
+	t.Logf("%.0f MB/s, %.2f%% spent limiting", float64(l.Reads.total.Load())/elapsed.Seconds()/1e6, 100*limiting.Seconds()/elapsed.Seconds())
+	if limiting > elapsed/20 {
+		t.Errorf("spent %v of %v limiting", limiting, elapsed)
+	}
+}
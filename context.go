@@ -0,0 +1,17 @@
+package bwlimit
+
+import "context"
+
+type limiterKey struct{}
+
+// WithLimiter returns a copy of ctx carrying l, for use by a Dialer without
+// a Limiter of it's own and by RoundTripper.
+func WithLimiter(ctx context.Context, l *Limiter) context.Context {
+	return context.WithValue(ctx, limiterKey{}, l)
+}
+
+// LimiterFromContext returns the Limiter carried by ctx, or nil if none.
+func LimiterFromContext(ctx context.Context) (l *Limiter) {
+	l, _ = ctx.Value(limiterKey{}).(*Limiter)
+	return
+}
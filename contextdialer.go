@@ -8,3 +8,10 @@ import (
 type ContextDialer interface {
 	DialContext(ctx context.Context, network, address string) (conn net.Conn, err error)
 }
+
+// dialFunc adapts a dial function to a ContextDialer.
+type dialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (f dialFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
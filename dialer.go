@@ -5,17 +5,31 @@ import (
 	"net"
 )
 
+// A Dialer wraps the connections dialed by a ContextDialer in Conns.
+//
+// If Limiter is nil, the Limiter carried by the DialContext context is
+// used instead, see WithLimiter, and connections dialed without one are
+// returned unwrapped.
 type Dialer struct {
-	ContextDialer // ContextDialer we wrap
-	*Limiter      // Limiter to use
+	ContextDialer              // ContextDialer we wrap
+	*Limiter                   // Limiter to use, if nil taken from the context
+	Dials         *DialLimiter // if not nil, limits dial attempts
 }
 
 func (d *Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
-	if conn, err = d.ContextDialer.DialContext(ctx, network, address); err == nil {
-		conn = &Conn{
-			Conn:    conn,
-			Limiter: d.Limiter,
+	if d.Dials != nil {
+		var release func()
+		if release, err = d.Dials.Wait(ctx, address); err != nil {
+			return
 		}
+		defer release()
+	}
+	l := d.Limiter
+	if l == nil {
+		l = LimiterFromContext(ctx)
+	}
+	if conn, err = d.ContextDialer.DialContext(ctx, network, address); err == nil && l != nil {
+		conn = NewConn(conn, l)
 	}
 	return
 }
@@ -71,3 +71,31 @@ func TestDialer_Dial(t *testing.T) {
 		t.Error(r1)
 	}
 }
+
+func TestDialer_DialContext_fromContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+
+	l := NewLimiter()
+	defer l.Stop()
+	d := &Dialer{ContextDialer: DefaultNetDialer}
+
+	conn, err := d.DialContext(WithLimiter(t.Context(), l), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if c, ok := conn.(*Conn); !ok || c.Limiter != l {
+		t.Errorf("%T", conn)
+	}
+
+	conn2, err := d.DialContext(t.Context(), "tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close()
+	if _, ok := conn2.(*Conn); ok {
+		t.Errorf("%T", conn2)
+	}
+}
@@ -0,0 +1,187 @@
+package bwlimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A DialLimiter limits the rate and concurrency of dial attempts, both in
+// total and per destination host. Dials that have to wait are counted in
+// Delayed, and dials that fail because their context is done while
+// waiting are counted in Rejected.
+//
+// The zero value is ready to use and does not limit anything.
+type DialLimiter struct {
+	Rate           atomic.Int64 // dial attempts per second, zero for unlimited
+	Concurrent     atomic.Int64 // dials in flight, zero for unlimited
+	HostRate       atomic.Int64 // dial attempts per second per host, zero for unlimited
+	HostConcurrent atomic.Int64 // dials in flight per host, zero for unlimited
+	Delayed        atomic.Int64 // number of dials that had to wait
+	Rejected       atomic.Int64 // number of dials that gave up waiting
+	all            dialGate
+	mu             sync.Mutex // protects following
+	hosts          map[string]*dialGate
+	sweep          int // sweep idle hosts when this many are known
+}
+
+// A dialGate limits the rate and concurrency of dial attempts.
+type dialGate struct {
+	users    int // protected by DialLimiter.mu
+	mu       sync.Mutex
+	next     time.Time     // earliest time for the next attempt
+	inflight int64         // dials in progress
+	freeCh   chan struct{} // if not nil, closed when a dial finishes
+}
+
+// acquire waits until a dial may start, limited to rate per second
+// and max concurrent dials, and returns the rate slot reserved for it.
+// If ctx is done first, the slot is given back.
+func (g *dialGate) acquire(ctx context.Context, rate, max int64) (slot time.Time, delayed bool, err error) {
+	g.mu.Lock()
+	if rate > 0 {
+		now := time.Now()
+		slot = g.next
+		if slot.Before(now) {
+			slot = now
+		}
+		g.next = slot.Add(time.Second / time.Duration(rate))
+		if d := slot.Sub(now); d > 0 {
+			delayed = true
+			g.mu.Unlock()
+			timer := time.NewTimer(d)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				g.mu.Lock()
+				g.giveback(slot, rate)
+				g.mu.Unlock()
+				return slot, delayed, ctx.Err()
+			}
+			g.mu.Lock()
+		}
+	}
+	for max > 0 && g.inflight >= max {
+		delayed = true
+		if g.freeCh == nil {
+			g.freeCh = make(chan struct{})
+		}
+		freeCh := g.freeCh
+		g.mu.Unlock()
+		select {
+		case <-freeCh:
+		case <-ctx.Done():
+			g.mu.Lock()
+			g.giveback(slot, rate)
+			g.mu.Unlock()
+			return slot, delayed, ctx.Err()
+		}
+		g.mu.Lock()
+	}
+	g.inflight++
+	g.mu.Unlock()
+	return
+}
+
+// giveback returns slot, reserved at rate for a dial that won't happen,
+// so that the next attempt can have it. Only the most recently reserved
+// slot can be given back, since later dials already wait for their own.
+// It must be called with g.mu held.
+func (g *dialGate) giveback(slot time.Time, rate int64) {
+	if rate > 0 && g.next.Equal(slot.Add(time.Second/time.Duration(rate))) {
+		g.next = slot
+	}
+}
+
+// cancel undoes a successful acquire of slot at rate for a dial that won't happen.
+func (g *dialGate) cancel(slot time.Time, rate int64) {
+	g.mu.Lock()
+	g.giveback(slot, rate)
+	g.mu.Unlock()
+	g.release()
+}
+
+// release marks a dial started by acquire as finished.
+func (g *dialGate) release() {
+	g.mu.Lock()
+	g.inflight--
+	if g.freeCh != nil {
+		close(g.freeCh)
+		g.freeCh = nil
+	}
+	g.mu.Unlock()
+}
+
+// idle returns true if the dialGate has no state worth keeping.
+func (g *dialGate) idle(now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.inflight == 0 && !g.next.After(now)
+}
+
+// host returns the dialGate for host.
+func (dl *DialLimiter) host(host string) (g *dialGate) {
+	dl.mu.Lock()
+	defer dl.mu.Unlock()
+	if g = dl.hosts[host]; g == nil {
+		if len(dl.hosts) >= dl.sweep {
+			now := time.Now()
+			for h, hg := range dl.hosts {
+				if hg.users == 0 && hg.idle(now) {
+					delete(dl.hosts, h)
+				}
+			}
+			dl.sweep = max(64, 2*len(dl.hosts))
+		}
+		if dl.hosts == nil {
+			dl.hosts = make(map[string]*dialGate)
+		}
+		g = &dialGate{}
+		dl.hosts[host] = g
+	}
+	g.users++
+	return
+}
+
+// unhost releases a dialGate returned by host.
+func (dl *DialLimiter) unhost(g *dialGate) {
+	dl.mu.Lock()
+	g.users--
+	dl.mu.Unlock()
+}
+
+// Wait blocks until a dial to address may start, or ctx is done.
+// On success, the caller must call release when the dial has finished.
+func (dl *DialLimiter) Wait(ctx context.Context, address string) (release func(), err error) {
+	host, _, e := net.SplitHostPort(address)
+	if e != nil {
+		host = address
+	}
+	hg := dl.host(host)
+	hostRate := dl.HostRate.Load()
+	var delayed, d bool
+	var slot time.Time
+	if slot, delayed, err = hg.acquire(ctx, hostRate, dl.HostConcurrent.Load()); err == nil {
+		if _, d, err = dl.all.acquire(ctx, dl.Rate.Load(), dl.Concurrent.Load()); err != nil {
+			hg.cancel(slot, hostRate)
+		}
+		delayed = delayed || d
+	}
+	if delayed {
+		dl.Delayed.Add(1)
+	}
+	if err != nil {
+		dl.Rejected.Add(1)
+		dl.unhost(hg)
+		return
+	}
+	release = func() {
+		dl.all.release()
+		hg.release()
+		dl.unhost(hg)
+	}
+	return
+}
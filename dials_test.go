@@ -0,0 +1,210 @@
+package bwlimit
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+// pipeDialer dials net.Pipe connections, taking delay to do so.
+type pipeDialer struct {
+	delay    time.Duration
+	inflight atomic.Int64
+	peak     atomic.Int64
+}
+
+func (pd *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n := pd.inflight.Add(1)
+	defer pd.inflight.Add(-1)
+	for {
+		peak := pd.peak.Load()
+		if n <= peak || pd.peak.CompareAndSwap(peak, n) {
+			break
+		}
+	}
+	time.Sleep(pd.delay)
+	c1, c2 := net.Pipe()
+	_ = c2.Close()
+	return c1, nil
+}
+
+func TestDialLimiter_Rate(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+
+		var dials DialLimiter
+		dials.Rate.Store(10)
+		d := &Dialer{ContextDialer: &pipeDialer{}, Limiter: l, Dials: &dials}
+
+		now := time.Now()
+		for range 3 {
+			conn, err := d.DialContext(t.Context(), "tcp", "example.com:80")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+		}
+		if elapsed := time.Since(now); elapsed != 200*time.Millisecond {
+			t.Error(elapsed)
+		}
+		if n := dials.Delayed.Load(); n != 2 {
+			t.Error(n)
+		}
+
+		// A dial that can't start before its context is done is rejected.
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		if _, err := d.DialContext(ctx, "tcp", "example.com:80"); err != context.DeadlineExceeded {
+			t.Error(err)
+		}
+		if n := dials.Rejected.Load(); n != 1 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestDialLimiter_HostConcurrent(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+
+		var dials DialLimiter
+		dials.Concurrent.Store(3)
+		dials.HostConcurrent.Store(2)
+		pd := &pipeDialer{delay: time.Second}
+		d := &Dialer{ContextDialer: pd, Limiter: l, Dials: &dials}
+
+		now := time.Now()
+		var wg sync.WaitGroup
+		for _, address := range []string{"a:80", "a:80", "a:443", "b:80", "b:80"} {
+			wg.Go(func() {
+				conn, err := d.DialContext(t.Context(), "tcp", address)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = conn.Close()
+			})
+		}
+		wg.Wait()
+		// At most 3 in flight, at most 2 of them to host "a".
+		if peak := pd.peak.Load(); peak != 3 {
+			t.Error(peak)
+		}
+		if elapsed := time.Since(now); elapsed != 2*time.Second {
+			t.Error(elapsed)
+		}
+		if n := dials.Delayed.Load(); n != 2 {
+			t.Error(n)
+		}
+		if n := dials.Rejected.Load(); n != 0 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestDialLimiter_giveback(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var dials DialLimiter
+		dials.HostRate.Store(1)
+		dials.Concurrent.Store(1)
+
+		now := time.Now()
+		release, err := dials.Wait(t.Context(), "a:80")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Rejected while waiting for the host rate slot at 1s.
+		ctx, cancel := context.WithTimeout(t.Context(), 500*time.Millisecond)
+		defer cancel()
+		if _, err := dials.Wait(ctx, "a:80"); err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+		// Rejected by the global gate after getting the host rate slot at 1s.
+		ctx, cancel = context.WithTimeout(t.Context(), time.Second)
+		defer cancel()
+		if _, err := dials.Wait(ctx, "a:80"); err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+		if n := dials.Rejected.Load(); n != 2 {
+			t.Error(n)
+		}
+
+		// Both rejected dials gave back their host rate slot.
+		release()
+		if release, err = dials.Wait(t.Context(), "a:80"); err != nil {
+			t.Fatal(err)
+		}
+		release()
+		if elapsed := time.Since(now); elapsed != 1500*time.Millisecond {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestDialLimiter_giveback_later(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var dials DialLimiter
+		dials.Rate.Store(10)
+
+		now := time.Now()
+		if _, err := dials.Wait(t.Context(), "a:80"); err != nil {
+			t.Fatal(err)
+		}
+		// Waits for the slot at 100ms, but gives up at 50ms.
+		ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+		defer cancel()
+		rejected := make(chan error, 1)
+		go func() {
+			_, err := dials.Wait(ctx, "a:80")
+			rejected <- err
+		}()
+		synctest.Wait()
+		// Waits for the slot at 200ms.
+		go func() {
+			_, _ = dials.Wait(t.Context(), "a:80")
+		}()
+		if err := <-rejected; err != context.DeadlineExceeded {
+			t.Fatal(err)
+		}
+
+		// The slot at 100ms was not the most recent, so it is not given back,
+		// and the next dial must not share the slot at 200ms.
+		if _, err := dials.Wait(t.Context(), "a:80"); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(now); elapsed != 300*time.Millisecond {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestDialLimiter_sweep(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var dials DialLimiter
+		dials.HostRate.Store(1)
+		for i := range 1000 {
+			release, err := dials.Wait(t.Context(), net.JoinHostPort(net.IPv4(10, 0, byte(i/256), byte(i)).String(), "80"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+			if i%100 == 0 {
+				time.Sleep(time.Second)
+			}
+		}
+		if n := len(dials.hosts); n > 200 {
+			t.Error(n)
+		}
+	})
+}
@@ -21,10 +21,8 @@ func ExampleLimiter_NewLimiter() {
 	lim := bwlimit.NewLimiter(100, 0)
 	defer lim.Stop()
 
-	// Clone the default transport so we avoid global side effects.
-	tp := http.DefaultTransport.(*http.Transport).Clone()
-	tp.DialContext = lim.Wrap(nil).DialContext
-	client := &http.Client{Transport: tp}
+	// Get a client using a clone of the default transport, so we avoid global side effects.
+	client := lim.HTTPClient()
 
 	// make a request and time it
 	now := time.Now()
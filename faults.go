@@ -0,0 +1,190 @@
+package bwlimit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrInjected is returned by Conn reads and writes failed by fault injection.
+var ErrInjected = errors.New("bwlimit: injected fault")
+
+// ErrReset is returned by Conn reads and writes after fault injection
+// has reset the connection. It wraps ErrInjected.
+var ErrReset = fmt.Errorf("%w: connection reset", ErrInjected)
+
+// Faults describes failures injected into Conns using a Limiter.
+// Probabilities are in the range [0, 1] and are rolled for each
+// call to the underlying net.Conn's Read or Write.
+//
+// Each Conn created by NewConn rolls using it's own random source for reads
+// and another for writes, seeded from Seed and the order in which the Conns
+// were created, so a given Seed injects the same faults into the same Conns
+// regardless of how they are used concurrently.
+type Faults struct {
+	StallProbability    float64       // probability that a read or write stalls
+	StallDuration       time.Duration // how long a stall lasts
+	ResetAfter          int64         // if positive, reset each Conn after this many bytes read and written, sending a TCP RST if possible
+	TruncateProbability float64       // probability that a write is cut short with io.ErrShortWrite
+	ErrorProbability    float64       // probability that a read or write fails with ErrInjected
+	Seed                uint64        // seed for the random source, zero for a random seed
+}
+
+// Injected counts the faults injected into Conns using a Limiter.
+type Injected struct {
+	Stalls      atomic.Int64
+	Resets      atomic.Int64
+	Truncations atomic.Int64
+	Errors      atomic.Int64
+}
+
+// faults is a Faults with the seed to use.
+type faults struct {
+	Faults
+	seed uint64
+}
+
+func newFaults(f *Faults) (fs *faults) {
+	if f != nil {
+		fs = &faults{Faults: *f, seed: f.Seed}
+		if fs.seed == 0 {
+			fs.seed = rand.Uint64()
+		}
+	}
+	return
+}
+
+// A faultRand is the random source for injecting fs into one direction of
+// a Conn. Each Conn and direction has it's own, so that which faults are
+// injected doesn't depend on how goroutines using other Conns interleave.
+type faultRand struct {
+	fs  *faults
+	mu  sync.Mutex // protects rnd
+	rnd *rand.Rand
+}
+
+// faultrand returns the random source for injecting fs into reads or
+// writes, starting a new one seeded with the Conn's sequence number
+// whenever the faults change.
+func (c *Conn) faultrand(fs *faults, write bool) (fr *faultRand) {
+	var dir uint64
+	if write {
+		dir = 1
+	}
+	p := &c.faultrnd[dir]
+	if fr = p.Load(); fr == nil || fr.fs != fs {
+		fr = &faultRand{fs: fs, rnd: rand.New(rand.NewPCG(fs.seed, c.seq<<1|dir))}
+		p.Store(fr)
+	}
+	return
+}
+
+// roll returns true with probability p.
+func (fr *faultRand) roll(p float64) (yes bool) {
+	if p > 0 {
+		fr.mu.Lock()
+		yes = fr.rnd.Float64() < p
+		fr.mu.Unlock()
+	}
+	return
+}
+
+// intn returns a random number in [0, n).
+func (fr *faultRand) intn(n int) (x int) {
+	fr.mu.Lock()
+	x = fr.rnd.IntN(n)
+	fr.mu.Unlock()
+	return
+}
+
+// stall waits for d, failing early if the read or write deadline
+// passes or the Conn is closed.
+func (c *Conn) stall(d time.Duration, write bool) (err error) {
+	deadline := c.rdeadline.Load()
+	if write {
+		deadline = c.wdeadline.Load()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var deadlineCh <-chan time.Time
+	if deadline != 0 {
+		dt := time.NewTimer(time.Until(time.Unix(0, deadline)))
+		defer dt.Stop()
+		deadlineCh = dt.C
+	}
+	select {
+	case <-timer.C:
+	case <-deadlineCh:
+		err = os.ErrDeadlineExceeded
+	case <-c.closeCh:
+		err = net.ErrClosed
+	}
+	return
+}
+
+// setLinger0 makes closing the TCP connection underlying conn
+// send a reset to the peer instead of an orderly shutdown.
+func setLinger0(conn net.Conn) error {
+	for {
+		switch v := conn.(type) {
+		case *Conn:
+			conn = v.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = v.NetConn()
+		case interface{ SetLinger(sec int) error }:
+			return v.SetLinger(0)
+		default:
+			return errors.ErrUnsupported
+		}
+	}
+}
+
+// inject returns fn wrapped so that it fails according to fs.
+func (c *Conn) inject(fs *faults, fn func([]byte) (int, error), write bool) func([]byte) (int, error) {
+	return func(b []byte) (n int, err error) {
+		if c.reset.Load() {
+			return 0, ErrReset
+		}
+		fr := c.faultrand(fs, write)
+		if fr.roll(fs.StallProbability) {
+			c.Limiter.Injected.Stalls.Add(1)
+			if err = c.stall(fs.StallDuration, write); err != nil {
+				return
+			}
+		}
+		if fr.roll(fs.ErrorProbability) {
+			c.Limiter.Injected.Errors.Add(1)
+			return 0, ErrInjected
+		}
+		if fs.ResetAfter > 0 {
+			b = b[:min(int64(len(b)), max(0, fs.ResetAfter-c.faulted.Load()))]
+		}
+		var truncated bool
+		if write && len(b) > 1 && fr.roll(fs.TruncateProbability) {
+			b = b[:1+fr.intn(len(b)-1)]
+			truncated = true
+		}
+		if len(b) > 0 {
+			n, err = fn(b)
+		}
+		if fs.ResetAfter > 0 && c.faulted.Add(int64(n)) >= fs.ResetAfter {
+			if !c.reset.Swap(true) {
+				c.Limiter.Injected.Resets.Add(1)
+				_ = setLinger0(c.Conn)
+				_ = c.Conn.Close()
+			}
+			return n, ErrReset
+		}
+		if truncated && err == nil {
+			c.Limiter.Injected.Truncations.Add(1)
+			err = io.ErrShortWrite
+		}
+		return
+	}
+}
@@ -0,0 +1,223 @@
+package bwlimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestFaults_ResetAfter(t *testing.T) {
+	l := NewLimiter()
+	defer l.Stop()
+	l.SetFaults(&Faults{ResetAfter: 15})
+	if f := l.Faults(); f == nil || f.ResetAfter != 15 {
+		t.Fatal(f)
+	}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, c2)
+	}()
+	conn := &Conn{Conn: c1, Limiter: l}
+
+	if n, err := conn.Write(make([]byte, 10)); n != 10 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := conn.Write(make([]byte, 10)); n != 5 || !errors.Is(err, ErrReset) {
+		t.Fatal(n, err)
+	}
+	if n, err := conn.Read(make([]byte, 10)); n != 0 || !errors.Is(err, ErrInjected) {
+		t.Fatal(n, err)
+	}
+	if n := l.Injected.Resets.Load(); n != 1 {
+		t.Error(n)
+	}
+}
+
+func TestFaults_Errors_Truncate(t *testing.T) {
+	l := NewLimiter()
+	defer l.Stop()
+	l.SetFaults(&Faults{ErrorProbability: 0.25, TruncateProbability: 0.25, Seed: 1})
+
+	var errs, shorts int
+	for range 1000 {
+		c1, c2 := net.Pipe()
+		go func() {
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		conn := NewConn(c1, l)
+		n, err := conn.Write(make([]byte, 100))
+		switch {
+		case err == nil:
+			if n != 100 {
+				t.Fatal(n)
+			}
+		case errors.Is(err, ErrInjected):
+			errs++
+		case errors.Is(err, io.ErrShortWrite):
+			if n < 1 || n >= 100 {
+				t.Fatal(n)
+			}
+			shorts++
+		default:
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+		_ = c2.Close()
+	}
+
+	if errs < 200 || errs > 300 {
+		t.Error(errs)
+	}
+	if shorts < 150 || shorts > 225 {
+		t.Error(shorts)
+	}
+	if n := l.Injected.Errors.Load(); n != int64(errs) {
+		t.Error(n, errs)
+	}
+	if n := l.Injected.Truncations.Load(); n != int64(shorts) {
+		t.Error(n, shorts)
+	}
+}
+
+func TestFaults_Stall(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+		l.SetFaults(&Faults{StallProbability: 1, StallDuration: time.Second})
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		conn := &Conn{Conn: c1, Limiter: l}
+		defer conn.Close()
+
+		now := time.Now()
+		if n, err := conn.Write(make([]byte, 10)); n != 10 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != time.Second {
+			t.Error(elapsed)
+		}
+		if n := l.Injected.Stalls.Load(); n != 1 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestFaults_ResetAfter_tcp(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reset is reported as WSAECONNRESET")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	l := NewLimiter()
+	defer l.Stop()
+	l.SetFaults(&Faults{ResetAfter: 5})
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			c := NewConn(conn, l)
+			defer c.Close()
+			// Wait for the dial to complete before resetting.
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				_, _ = c.Write(make([]byte, 10))
+			}
+		}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	// The peer sees a reset rather than an orderly EOF.
+	if _, err = io.Copy(io.Discard, conn); !errors.Is(err, syscall.ECONNRESET) {
+		t.Error(err)
+	}
+}
+
+func TestFaults_Stall_deadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+		l.SetFaults(&Faults{StallProbability: 1, StallDuration: time.Hour})
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		conn := NewConn(c1, l)
+
+		now := time.Now()
+		_ = conn.SetWriteDeadline(now.Add(time.Second))
+		if n, err := conn.Write(make([]byte, 10)); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != time.Second {
+			t.Error(elapsed)
+		}
+
+		go func() {
+			time.Sleep(time.Second)
+			_ = conn.Close()
+		}()
+		if n, err := conn.Read(make([]byte, 10)); n != 0 || !errors.Is(err, net.ErrClosed) {
+			t.Error(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != 2*time.Second {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestFaults_Seed(t *testing.T) {
+	// run returns which writes failed on each of two Conns
+	// used concurrently.
+	run := func() (failed [2][100]bool) {
+		l := NewLimiter()
+		defer l.Stop()
+		l.SetFaults(&Faults{ErrorProbability: 0.5, Seed: 1})
+		var conns [2]*Conn
+		for i := range conns {
+			c1, c2 := net.Pipe()
+			defer c2.Close()
+			go func() {
+				_, _ = io.Copy(io.Discard, c2)
+			}()
+			conns[i] = NewConn(c1, l)
+			defer conns[i].Close()
+		}
+		var wg sync.WaitGroup
+		for i, conn := range conns {
+			wg.Go(func() {
+				for j := range failed[i] {
+					_, err := conn.Write([]byte("x"))
+					failed[i][j] = err != nil
+				}
+			})
+		}
+		wg.Wait()
+		return
+	}
+	if a, b := run(), run(); a != b {
+		t.Error("same Seed injected different faults")
+	}
+}
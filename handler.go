@@ -0,0 +1,158 @@
+package bwlimit
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// A Selector chooses the Limiter to use for a request,
+// for example by path, header, authenticated user or ClientIP.
+// Returning nil leaves the request unlimited.
+type Selector func(r *http.Request) *Limiter
+
+// Handler returns an http.Handler that calls next with the response
+// body writes bandwidth limited by l.Writes.
+func Handler(l *Limiter, next http.Handler) http.Handler {
+	return SelectHandler(func(*http.Request) *Limiter { return l }, next)
+}
+
+// SelectHandler returns an http.Handler that calls next with the response
+// body writes bandwidth limited by the Writes of the Limiter chosen by sel.
+//
+// The first Writes.Burst bytes of each response bypass the limit.
+// Writes waiting for budget fail with the request context error if
+// the request context is done.
+func SelectHandler(sel Selector, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l := sel(r); l != nil {
+			w = &ResponseWriter{
+				ResponseWriter: w,
+				limiter:        l,
+				ctx:            r.Context(),
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// BodyHandler returns an http.Handler that calls next with the request
+// body reads bandwidth limited by the Reads of the Limiter chosen by sel.
+// If maxBytes is positive, the body is also limited in size like
+// with http.MaxBytesReader.
+//
+// The first Reads.Burst bytes of each request body bypass the limit.
+// Reads waiting for budget fail with the request context error if
+// the request context is done, or with os.ErrDeadlineExceeded once
+// a read deadline set using http.ResponseController passes.
+func BodyHandler(sel Selector, maxBytes int64, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			if maxBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+			}
+			if l := sel(r); l != nil {
+				body := newBody(r.Context(), r.Body, l.Reads)
+				r.Body = body
+				w = &bodyWriter{ResponseWriter: w, body: body}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the IP address of the client that sent r,
+// taken from r.RemoteAddr.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return host
+}
+
+// ResponseWriter is an http.ResponseWriter with bandwidth limited writes.
+// Use http.ResponseController to reach the underlying http.ResponseWriter.
+type ResponseWriter struct {
+	http.ResponseWriter // underlying http.ResponseWriter
+	limiter             *Limiter
+	ctx                 context.Context
+	written             atomic.Int64
+}
+
+func (w *ResponseWriter) Write(b []byte) (n int, err error) {
+	n, err = w.limiter.Writes.doio(w.ResponseWriter.Write, b, &throttle{
+		block:  true,
+		done:   w.ctx.Done(),
+		err:    w.ctx.Err,
+		stream: &w.written,
+	})
+	w.written.Add(int64(n))
+	return
+}
+
+// Unwrap returns the underlying http.ResponseWriter.
+func (w *ResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Body is an http.Request or http.Response body with bandwidth limited reads.
+type Body struct {
+	io.ReadCloser            // underlying body
+	op            *Operation // Operation to use
+	ctx           context.Context
+	read          atomic.Int64
+	deadline      atomic.Int64 // UnixNano of read deadline, zero if none
+}
+
+func newBody(ctx context.Context, rc io.ReadCloser, op *Operation) *Body {
+	return &Body{
+		ReadCloser: rc,
+		op:         op,
+		ctx:        ctx,
+	}
+}
+
+// SetReadDeadline makes reads stop waiting for bandwidth budget and fail
+// with os.ErrDeadlineExceeded once t passes. A zero t means no deadline.
+// It does not set a deadline on the underlying body.
+func (b *Body) SetReadDeadline(t time.Time) error {
+	storeDeadline(&b.deadline, t)
+	return nil
+}
+
+func (b *Body) Read(p []byte) (n int, err error) {
+	t := throttle{
+		block:  true,
+		reader: true,
+		done:   b.ctx.Done(),
+		err:    b.ctx.Err,
+		stream: &b.read,
+	}
+	if d := b.deadline.Load(); d != 0 {
+		t.deadline = time.Unix(0, d)
+	}
+	n, err = b.op.doio(b.ReadCloser.Read, p, &t)
+	b.read.Add(int64(n))
+	return
+}
+
+// bodyWriter is the http.ResponseWriter passed on by BodyHandler, so that
+// read deadlines set using http.ResponseController also apply to the Body.
+type bodyWriter struct {
+	http.ResponseWriter
+	body *Body
+}
+
+func (w *bodyWriter) SetReadDeadline(t time.Time) error {
+	_ = w.body.SetReadDeadline(t)
+	return http.NewResponseController(w.ResponseWriter).SetReadDeadline(t)
+}
+
+// Unwrap returns the underlying http.ResponseWriter.
+func (w *bodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
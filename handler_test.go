@@ -0,0 +1,192 @@
+package bwlimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 100)
+		defer l.Stop()
+		l.Writes.Burst.Store(10)
+
+		h := Handler(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := w.(*ResponseWriter); !ok {
+				t.Errorf("%T", w)
+			}
+			_, _ = w.Write(make([]byte, 30))
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				t.Error(err)
+			}
+		}))
+
+		for range 2 {
+			now := time.Now()
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			if n := rec.Body.Len(); n != 30 || !rec.Flushed {
+				t.Error(n, rec.Flushed)
+			}
+			// The first 10 bytes of each response bypass the limit,
+			// then 10 bytes per time slice.
+			if elapsed := time.Since(now); elapsed != interval {
+				t.Error(elapsed)
+			}
+			<-l.WaitCh()
+		}
+	})
+}
+
+func TestSelectHandler(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 100)
+		defer l.Stop()
+
+		h := SelectHandler(func(r *http.Request) *Limiter {
+			if r.Header.Get("X-Slow") != "" {
+				return l
+			}
+			return nil
+		}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(make([]byte, 30))
+		}))
+
+		now := time.Now()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		if elapsed := time.Since(now); elapsed != 0 {
+			t.Error(elapsed)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Slow", "1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if elapsed := time.Since(now); elapsed != 2*interval {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestHandler_canceled(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 100)
+		defer l.Stop()
+
+		var n int
+		var err error
+		h := Handler(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, err = w.Write(make([]byte, 1000))
+		}))
+		r := httptest.NewRequest("GET", "/", nil)
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+		if n < 100 || n > 110 || err != context.DeadlineExceeded {
+			t.Error(n, err)
+		}
+	})
+}
+
+func TestBodyHandler(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100, 0)
+		defer l.Stop()
+		l.Reads.Burst.Store(10)
+
+		var n int64
+		var err error
+		h := BodyHandler(func(*http.Request) *Limiter { return l }, 30, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, err = io.Copy(io.Discard, r.Body)
+		}))
+
+		now := time.Now()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 30))))
+		if n != 30 || err != nil {
+			t.Error(n, err)
+		}
+		// The first 10 bytes bypass the limit, then 10 bytes per time slice,
+		// and the read that finds EOF needs budget too.
+		if elapsed := time.Since(now); elapsed != 2*interval {
+			t.Error(elapsed)
+		}
+
+		var maxErr *http.MaxBytesError
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 40))))
+		if n != 30 || !errors.As(err, &maxErr) {
+			t.Error(n, err)
+		}
+	})
+}
+
+func TestBodyHandler_canceled(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100, 0)
+		defer l.Stop()
+
+		var n int64
+		var err error
+		h := BodyHandler(func(*http.Request) *Limiter { return l }, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n, err = io.Copy(io.Discard, r.Body)
+		}))
+		r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 1000)))
+		ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+		defer cancel()
+		h.ServeHTTP(httptest.NewRecorder(), r.WithContext(ctx))
+		if n < 100 || n > 110 || err != context.DeadlineExceeded {
+			t.Error(n, err)
+		}
+	})
+}
+
+func TestBodyHandler_deadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100, 0)
+		defer l.Stop()
+
+		var n int64
+		var err, setErr error
+		h := BodyHandler(func(*http.Request) *Limiter { return l }, 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// The recorder has no read deadline, but the Body does.
+			setErr = http.NewResponseController(w).SetReadDeadline(time.Now().Add(time.Second))
+			n, err = io.Copy(io.Discard, r.Body)
+		}))
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, 1000))))
+		if !errors.Is(setErr, http.ErrNotSupported) {
+			t.Error(setErr)
+		}
+		if n < 100 || n > 110 || !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Error(n, err)
+		}
+	})
+}
+
+func TestClientIP(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "[::1]:1234"
+	if ip := ClientIP(r); ip != "::1" {
+		t.Error(ip)
+	}
+	r.RemoteAddr = "192.0.2.1"
+	if ip := ClientIP(r); ip != "192.0.2.1" {
+		t.Error(ip)
+	}
+}
@@ -0,0 +1,231 @@
+package bwlimit
+
+import (
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Distribution selects how latency jitter is distributed.
+type Distribution int
+
+const (
+	Uniform Distribution = iota // jitter uniformly distributed in [-Jitter, Jitter]
+	Normal                      // jitter normally distributed with standard deviation Jitter
+	Pareto                      // heavy-tailed positive jitter with mean Jitter
+)
+
+// paretoShape is the shape parameter used for Pareto jitter.
+const paretoShape = 3
+
+// Latency describes the delay added to written bytes before they
+// are delivered to the underlying net.Conn.
+type Latency struct {
+	Delay        time.Duration // fixed delay
+	Jitter       time.Duration // random variation of the delay
+	Distribution Distribution  // distribution of the jitter
+	Seed         uint64        // seed for the random source, zero for a random seed
+}
+
+// latency is a Latency together with it's random source.
+type latency struct {
+	Latency
+	mu  sync.Mutex // protects rnd
+	rnd *rand.Rand
+}
+
+func newLatency(lat *Latency) (l *latency) {
+	if lat != nil {
+		seed := lat.Seed
+		if seed == 0 {
+			seed = rand.Uint64()
+		}
+		l = &latency{
+			Latency: *lat,
+			rnd:     rand.New(rand.NewPCG(seed, seed)),
+		}
+	}
+	return
+}
+
+// sample returns a random delay, never less than zero.
+func (l *latency) sample() (d time.Duration) {
+	d = l.Delay
+	if l.Jitter > 0 {
+		l.mu.Lock()
+		var f float64
+		switch l.Distribution {
+		case Normal:
+			f = l.rnd.NormFloat64()
+		case Pareto:
+			// Lomax distribution, which has mean 1 when scaled by shape-1.
+			f = (math.Pow(1-l.rnd.Float64(), -1.0/paretoShape) - 1) * (paretoShape - 1)
+		default:
+			f = l.rnd.Float64()*2 - 1
+		}
+		l.mu.Unlock()
+		d += time.Duration(f * float64(l.Jitter))
+	}
+	return max(0, d)
+}
+
+// maxdelayed is the number of queued bytes above which writes to a delayer
+// wait for earlier writes to be delivered.
+const maxdelayed = 1 << 20
+
+type delayed struct {
+	b   []byte
+	due time.Time
+}
+
+// delayer writes to a net.Conn after a delay, preserving order.
+//
+// Delays are timed using the wall clock rather than the Ticker,
+// since they need a finer resolution than it's time slices.
+type delayer struct {
+	conn    net.Conn
+	deliver func([]byte) error // writes queued bytes, waiting for bandwidth budget
+	mu      sync.Mutex         // protects following
+	queue   []delayed
+	queued  int           // bytes in queue or being delivered
+	spaceCh chan struct{} // if not nil, closed when queued decreases
+	last    time.Time
+	running bool
+	closing bool
+	err     error
+	doneCh  chan struct{} // if not nil, closed once closing is done
+	closed  error         // result of closing conn
+}
+
+// write queues a copy of b to be written at due or after any previously
+// queued writes, whichever is later. If maxdelayed bytes are already queued,
+// it waits for some to be delivered, unless block is false in which case it
+// fails with ErrWouldThrottle. Waiting fails with os.ErrDeadlineExceeded
+// once deadline passes, if it is not zero.
+func (d *delayer) write(b []byte, due time.Time, block bool, deadline time.Time) (n int, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for d.err == nil && !d.closing && d.queued > 0 && d.queued+len(b) > maxdelayed {
+		if !block {
+			return 0, ErrWouldThrottle
+		}
+		if err = d.waitspace(deadline); err != nil {
+			return
+		}
+	}
+	if err = d.err; err == nil {
+		if d.closing {
+			return 0, net.ErrClosed
+		}
+		if due.Before(d.last) {
+			due = d.last
+		}
+		d.last = due
+		d.queue = append(d.queue, delayed{b: bytes.Clone(b), due: due})
+		d.queued += len(b)
+		if !d.running {
+			d.running = true
+			go d.run()
+		}
+		n = len(b)
+	}
+	return
+}
+
+// waitspace waits with d.mu held until queued bytes have been delivered
+// or deadline passes.
+func (d *delayer) waitspace(deadline time.Time) (err error) {
+	if d.spaceCh == nil {
+		d.spaceCh = make(chan struct{})
+	}
+	spaceCh := d.spaceCh
+	var timeoutCh <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	d.mu.Unlock()
+	defer d.mu.Lock()
+	select {
+	case <-spaceCh:
+	case <-timeoutCh:
+		err = os.ErrDeadlineExceeded
+	}
+	return
+}
+
+// delivered removes n bytes from the queued count and wakes waiting writers.
+// It must be called with d.mu held.
+func (d *delayer) delivered(n int) {
+	d.queued -= n
+	if d.spaceCh != nil {
+		close(d.spaceCh)
+		d.spaceCh = nil
+	}
+}
+
+func (d *delayer) run() {
+	for {
+		d.mu.Lock()
+		if len(d.queue) == 0 {
+			d.running = false
+			if d.closing {
+				d.closed = d.conn.Close()
+				if d.doneCh != nil {
+					close(d.doneCh)
+				}
+			}
+			d.mu.Unlock()
+			return
+		}
+		item := d.queue[0]
+		d.queue[0] = delayed{}
+		d.queue = d.queue[1:]
+		d.mu.Unlock()
+
+		time.Sleep(time.Until(item.due))
+		err := d.deliver(item.b)
+		d.mu.Lock()
+		d.delivered(len(item.b))
+		if err != nil && d.err == nil {
+			d.err = err
+			for _, item := range d.queue {
+				d.delivered(len(item.b))
+			}
+			d.queue = nil
+		}
+		d.mu.Unlock()
+	}
+}
+
+// close closes the net.Conn once all queued writes are written, and
+// waits for that to happen. It returns the first error from writing
+// the queued bytes, if any, or else the error from closing the net.Conn.
+func (d *delayer) close() (err error) {
+	d.mu.Lock()
+	d.closing = true
+	if !d.running {
+		defer d.mu.Unlock()
+		if err = d.conn.Close(); d.err != nil {
+			err = d.err
+		}
+		return
+	}
+	if d.doneCh == nil {
+		d.doneCh = make(chan struct{})
+	}
+	doneCh := d.doneCh
+	d.mu.Unlock()
+	<-doneCh
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err = d.err; err == nil {
+		err = d.closed
+	}
+	return
+}
@@ -0,0 +1,173 @@
+package bwlimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestLatency_sample(t *testing.T) {
+	for _, dist := range []Distribution{Uniform, Normal, Pareto} {
+		lat := newLatency(&Latency{
+			Delay:        100 * time.Millisecond,
+			Jitter:       10 * time.Millisecond,
+			Distribution: dist,
+			Seed:         1,
+		})
+		const samples = 10000
+		var sum time.Duration
+		for range samples {
+			d := lat.sample()
+			if d < 0 {
+				t.Fatal(dist, d)
+			}
+			if dist == Pareto && d < lat.Delay {
+				t.Fatal(dist, d)
+			}
+			sum += d
+		}
+		mean := sum / samples
+		want := lat.Delay
+		if dist == Pareto {
+			want += lat.Jitter
+		}
+		if diff := mean - want; diff < -time.Millisecond || diff > time.Millisecond {
+			t.Errorf("%v: mean %v want %v", dist, mean, want)
+		}
+	}
+}
+
+func TestLatency_seed(t *testing.T) {
+	lat1 := newLatency(&Latency{Jitter: time.Second, Seed: 42})
+	lat2 := newLatency(&Latency{Jitter: time.Second, Seed: 42})
+	for range 100 {
+		if d1, d2 := lat1.sample(), lat2.sample(); d1 != d2 {
+			t.Fatal(d1, d2)
+		}
+	}
+}
+
+func TestConn_latency(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+		l.SetLatency(&Latency{Delay: 50 * time.Millisecond, Jitter: 40 * time.Millisecond, Seed: 1})
+		if lat := l.Latency(); lat == nil || lat.Delay != 50*time.Millisecond {
+			t.Fatal(lat)
+		}
+
+		c1, c2 := net.Pipe()
+		conn := &Conn{Conn: c1, Limiter: l}
+
+		now := time.Now()
+		want := "0123456789"
+		for i := range want {
+			if n, err := conn.Write([]byte(want[i : i+1])); n != 1 || err != nil {
+				t.Fatal(n, err)
+			}
+		}
+		if elapsed := time.Since(now); elapsed != 0 {
+			t.Error("Write waited for delivery", elapsed)
+		}
+		closeErr := make(chan error, 1)
+		go func() { closeErr <- conn.Close() }()
+
+		got, err := io.ReadAll(c2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("got %q want %q", got, want)
+		}
+		if elapsed := time.Since(now); elapsed < 10*time.Millisecond || elapsed > 90*time.Millisecond {
+			t.Error(elapsed)
+		}
+		if err := <-closeErr; err != nil {
+			t.Error(err)
+		}
+		if _, err := conn.Write([]byte("x")); err != net.ErrClosed {
+			t.Error(err)
+		}
+	})
+}
+
+func TestConn_latency_limit(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 1000)
+		defer l.Stop()
+		l.SetLatency(&Latency{Delay: 100 * time.Millisecond})
+
+		c1, c2 := net.Pipe()
+		conn := NewConn(c1, l)
+
+		// The bandwidth limit applies when the bytes are delivered.
+		now := time.Now()
+		if n, err := conn.Write(make([]byte, 2000)); n != 2000 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != 0 {
+			t.Error("Write waited for delivery", elapsed)
+		}
+		closeErr := make(chan error, 1)
+		go func() { closeErr <- conn.Close() }()
+		if n, err := io.Copy(io.Discard, c2); n != 2000 || err != nil {
+			t.Fatal(n, err)
+		}
+		if err := <-closeErr; err != nil {
+			t.Error(err)
+		}
+		if elapsed := time.Since(now); elapsed < 1900*time.Millisecond || elapsed > 2100*time.Millisecond {
+			t.Error(elapsed)
+		}
+		if count := l.Writes.total.Load(); count != 2000 {
+			t.Error(count)
+		}
+	})
+}
+
+func TestConn_latency_queue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter()
+		defer l.Stop()
+		l.SetLatency(&Latency{Delay: time.Millisecond})
+
+		c1, c2 := net.Pipe()
+		conn := NewConn(c1, l)
+
+		// Nothing reads c2, so the queue stays full.
+		if n, err := conn.Write(make([]byte, maxdelayed)); n != maxdelayed || err != nil {
+			t.Fatal(n, err)
+		}
+		if n, err := conn.TryWrite([]byte("x")); n != 0 || err != ErrWouldThrottle {
+			t.Error(n, err)
+		}
+		written := make(chan error, 1)
+		go func() {
+			_, err := conn.Write([]byte("x"))
+			written <- err
+		}()
+		synctest.Wait()
+		select {
+		case err := <-written:
+			t.Fatal("Write did not wait", err)
+		default:
+		}
+
+		// Close returns the error from delivering the queued bytes.
+		_ = c2.Close()
+		if err := <-written; err != io.ErrClosedPipe {
+			t.Error(err)
+		}
+		if err := conn.Close(); err != io.ErrClosedPipe {
+			t.Error(err)
+		}
+	})
+}
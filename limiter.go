@@ -1,30 +1,63 @@
 package bwlimit
 
 import (
+	"context"
+	"errors"
+	"iter"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var DefaultNetDialer = &net.Dialer{}
 
 type Limiter struct {
 	*Ticker
-	Reads  *Operation
-	Writes *Operation
+	Reads    *Operation
+	Writes   *Operation
+	Total    *Operation // combined reads and writes
+	Injected Injected   // faults injected into Conns
+	// KernelPacing, if true, makes Conns on Linux leave write shaping to the
+	// kernel by setting SO_MAX_PACING_RATE on their TCP socket to Writes.Limit.
+	// The kernel paces each connection separately, so the limit applies per
+	// Conn rather than to all Conns together. Conns that don't support it, and
+	// all Conns while Total has a limit, use normal shaping instead.
+	KernelPacing atomic.Bool
+	lat          atomic.Pointer[latency]
+	faults       atomic.Pointer[faults]
+	connseq      atomic.Uint64 // sequence number of the last Conn created by NewConn
+	buftime      atomic.Int64  // see SetBufferTime
+	onClose      atomic.Pointer[func(*Conn, ConnStats)]
+	connsMu      sync.Mutex // protects following
+	conns        map[*Conn]struct{}
+	idleCh       chan struct{} // closed when conns becomes empty
 }
 
 // NewLimiter returns a new limiter from DefaultTicker.
 // If DefaultTicker has been stopped, returns nil.
 // If you provide limits, the first will set
-// both read and write limits, the second will set the write limit.
+// both read and write limits, the second will set the write limit
+// and the third will set a combined limit shared by reads and writes.
 // Limits are applied in 100ms slices with fractional carry-over between
 // slices, so very low rates are accurate over time but can be bursty
 // at slice boundaries.
 //
-// To stop the Limiter and free it's resources, call Stop.
+// To stop the Limiter and free it's resources, call Stop. A Limiter that
+// becomes unreachable, together with all it's Conns, is stopped automatically.
+// That stops it's Operations too, so keep the Limiter reachable for as long as
+// they are used on their own, such as by a Controller or for WaitN, AllowN or
+// Reserve, or they will behave as if stopped.
 func NewLimiter(limits ...int64) *Limiter {
 	return DefaultTicker.NewLimiter(limits...)
 }
 
+// NewLimiterContext is like NewLimiter, but the Limiter is
+// stopped when ctx is done.
+func NewLimiterContext(ctx context.Context, limits ...int64) *Limiter {
+	return DefaultTicker.NewLimiterContext(ctx, limits...)
+}
+
 // Stop stops the Limiter and frees any resources. Reads and writes on
 // a stopped and rate-limited Limiter returns io.EOF. On an unlimited
 // Limiter they function as normal.
@@ -33,6 +66,139 @@ func NewLimiter(limits ...int64) *Limiter {
 func (l *Limiter) Stop() {
 	l.Reads.Stop()
 	l.Writes.Stop()
+	l.Total.Stop()
+}
+
+// SetLatency makes Conns using this Limiter deliver written bytes to the
+// underlying net.Conn after a delay chosen according to lat, preserving
+// the order of writes. Writes return as soon as the bytes are queued, unless
+// a Conn already has 1 MiB queued, and the bandwidth limits apply to the
+// bytes as they are delivered.
+// Pass nil to stop adding latency to new writes.
+func (l *Limiter) SetLatency(lat *Latency) {
+	l.lat.Store(newLatency(lat))
+}
+
+// Latency returns the current latency settings, or nil if none.
+func (l *Limiter) Latency() (lat *Latency) {
+	if p := l.lat.Load(); p != nil {
+		cp := p.Latency
+		lat = &cp
+	}
+	return
+}
+
+// SetFaults makes Conns using this Limiter fail according to f.
+// Pass nil to stop injecting faults.
+func (l *Limiter) SetFaults(f *Faults) {
+	l.faults.Store(newFaults(f))
+}
+
+// Faults returns the current fault injection settings, or nil if none.
+func (l *Limiter) Faults() (f *Faults) {
+	if p := l.faults.Load(); p != nil {
+		cp := p.Faults
+		f = &cp
+	}
+	return
+}
+
+// SetOnClose sets a function to be called with the statistics of each
+// Conn using this Limiter when it is closed, for example to write
+// access logs. Pass nil to remove it.
+func (l *Limiter) SetOnClose(fn func(c *Conn, stats ConnStats)) {
+	if fn == nil {
+		l.onClose.Store(nil)
+	} else {
+		l.onClose.Store(&fn)
+	}
+}
+
+// track adds c to the set of active Conns.
+func (l *Limiter) track(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[*Conn]struct{})
+	}
+	l.conns[c] = struct{}{}
+}
+
+// untrack removes c from the set of active Conns.
+func (l *Limiter) untrack(c *Conn) {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	delete(l.conns, c)
+	if len(l.conns) == 0 && l.idleCh != nil {
+		close(l.idleCh)
+		l.idleCh = nil
+	}
+}
+
+// ActiveConns returns the number of Conns created by NewConn using this
+// Limiter that have not yet been closed.
+func (l *Limiter) ActiveConns() int {
+	l.connsMu.Lock()
+	defer l.connsMu.Unlock()
+	return len(l.conns)
+}
+
+// Conns returns an iterator over the active Conns and their statistics.
+// Conns created or closed while iterating may or may not be included.
+func (l *Limiter) Conns() iter.Seq2[*Conn, ConnStats] {
+	return func(yield func(*Conn, ConnStats) bool) {
+		l.connsMu.Lock()
+		conns := make([]*Conn, 0, len(l.conns))
+		for c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.connsMu.Unlock()
+		for _, c := range conns {
+			if !yield(c, c.Stats()) {
+				return
+			}
+		}
+	}
+}
+
+// CloseAll closes all active Conns.
+func (l *Limiter) CloseAll() error {
+	var errs []error
+	for c := range l.Conns() {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// Drain waits for all active Conns to be closed. If ctx is done
+// first, the remaining Conns are closed and ctx.Err() is returned.
+func (l *Limiter) Drain(ctx context.Context) (err error) {
+	l.connsMu.Lock()
+	var ch chan struct{}
+	if len(l.conns) > 0 {
+		if l.idleCh == nil {
+			l.idleCh = make(chan struct{})
+		}
+		ch = l.idleCh
+	}
+	l.connsMu.Unlock()
+	if ch != nil {
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			err = ctx.Err()
+			_ = l.CloseAll()
+		}
+	}
+	return
+}
+
+// delay returns a random delay according to the current latency settings.
+func (l *Limiter) delay() (d time.Duration) {
+	if p := l.lat.Load(); p != nil {
+		d = p.sample()
+	}
+	return
 }
 
 // alreadyLimits returns true if cd is already limited by this Limiter.
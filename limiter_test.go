@@ -2,8 +2,13 @@ package bwlimit
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net"
+	"runtime"
+	"sync"
 	"testing"
+	"testing/synctest"
 	"time"
 )
 
@@ -98,3 +103,251 @@ func TestLimiter_alreadyLimits_typedNilDialer(t *testing.T) {
 		t.Fatal("typed nil dialer should not be detected as already limited")
 	}
 }
+
+func TestLimiter_Total(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 0, 100)
+		defer l.Stop()
+
+		var wg sync.WaitGroup
+		now := time.Now()
+		wg.Go(func() {
+			_, _ = l.Reads.io(bytes.NewReader(make([]byte, 150)).Read, make([]byte, 150))
+		})
+		wg.Go(func() {
+			_, _ = l.Writes.io(io.Discard.Write, make([]byte, 150))
+		})
+		wg.Wait()
+		elapsed := time.Since(now)
+		<-l.WaitCh()
+		synctest.Wait()
+
+		// 300 bytes at 100 bytes/sec combined should take about 3 seconds.
+		if elapsed < 2*time.Second || elapsed > 4*time.Second {
+			t.Error(elapsed)
+		}
+		if rate := l.Total.Rate.Load(); rate < 90 || rate > 110 {
+			t.Error(rate)
+		}
+		l.Stop()
+		if n := l.Total.Count.Load(); n != 300 {
+			t.Error(n)
+		}
+		if n := l.Reads.Count.Load() + l.Writes.Count.Load(); n != 300 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestLimiter_Total_directionCap(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(50, 1000, 100)
+		defer l.Stop()
+
+		now := time.Now()
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 150)).Read, make([]byte, 150))
+		if n != 150 || err != nil {
+			t.Fatal(n, err)
+		}
+		// 150 bytes at 50 bytes/sec should take about 3 seconds.
+		if elapsed := time.Since(now); elapsed < 2*time.Second || elapsed > 4*time.Second {
+			t.Error(elapsed)
+		}
+
+		// Writes are capped by the combined limit.
+		now = time.Now()
+		n, err = l.Writes.io(io.Discard.Write, make([]byte, 150))
+		if n != 150 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed < time.Second || elapsed > 2*time.Second {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestLimiter_Conns_CloseAll(t *testing.T) {
+	l := NewLimiter()
+	defer l.Stop()
+
+	var peers []net.Conn
+	for range 3 {
+		c1, c2 := net.Pipe()
+		peers = append(peers, c2)
+		NewConn(c1, l)
+	}
+	if n := l.ActiveConns(); n != 3 {
+		t.Fatal(n)
+	}
+	for c, stats := range l.Conns() {
+		if c.Limiter != l || stats.Created.IsZero() {
+			t.Error(c, stats)
+		}
+		_ = c.Close()
+		break
+	}
+	if n := l.ActiveConns(); n != 2 {
+		t.Error(n)
+	}
+	if err := l.CloseAll(); err != nil {
+		t.Error(err)
+	}
+	if n := l.ActiveConns(); n != 0 {
+		t.Error(n)
+	}
+	for _, c := range peers {
+		if _, err := c.Write([]byte("x")); err != io.ErrClosedPipe {
+			t.Error(err)
+		}
+	}
+}
+
+func TestLimiter_Drain(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l := NewLimiter()
+		defer l.Stop()
+
+		if err := l.Drain(t.Context()); err != nil {
+			t.Error(err)
+		}
+
+		c1, _ := net.Pipe()
+		conn1 := NewConn(c1, l)
+
+		// Drain returns when the owner closes the last Conn.
+		go func() {
+			time.Sleep(time.Second)
+			_ = conn1.Close()
+		}()
+		now := time.Now()
+		if err := l.Drain(t.Context()); err != nil {
+			t.Error(err)
+		}
+		if elapsed := time.Since(now); elapsed != time.Second {
+			t.Error(elapsed)
+		}
+
+		// Drain closes remaining Conns when ctx is done.
+		c2, _ := net.Pipe()
+		NewConn(c2, l)
+		ctx, cancel := context.WithTimeout(t.Context(), 2*time.Second)
+		defer cancel()
+		if err := l.Drain(ctx); err != context.DeadlineExceeded {
+			t.Error(err)
+		}
+		if n := l.ActiveConns(); n != 0 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestLimiter_cleanup(t *testing.T) {
+	ticker := NewTicker()
+	defer ticker.Stop()
+
+	l := ticker.NewLimiter(0)
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	conn := NewConn(c1, l)
+	go func() {
+		_, _ = c2.Write([]byte("x"))
+	}()
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	op := l.Reads
+	l, conn = nil, nil
+
+	for range 100 {
+		runtime.GC()
+		if op.stopped() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !op.stopped() {
+		t.Fatal("unreachable Limiter was not stopped")
+	}
+	if n := op.Count.Load(); n != 1 {
+		t.Error(n)
+	}
+}
+
+func TestLimiter_NewLimiterContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	l := NewLimiterContext(ctx, 1000)
+	if l.Reads.stopped() {
+		t.Fatal("stopped early")
+	}
+	cancel()
+	for range 100 {
+		if l.Total.stopped() {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !l.Reads.stopped() || !l.Writes.stopped() || !l.Total.stopped() {
+		t.Error("not stopped")
+	}
+}
+
+func TestLimiter_idle_noGoroutines(t *testing.T) {
+	ticker := NewTicker()
+	defer ticker.Stop()
+
+	before := runtime.NumGoroutine()
+	ls := make([]*Limiter, 1000)
+	for i := range ls {
+		ls[i] = ticker.NewLimiter(1000)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d Limiters started %d goroutines", len(ls), after-before)
+	}
+	for _, l := range ls {
+		l.Stop()
+	}
+	if n := len(ticker.ops); n != 0 {
+		t.Error(n)
+	}
+}
+
+func BenchmarkLimiter_NewLimiter_100k(b *testing.B) {
+	ticker := NewTicker()
+	defer ticker.Stop()
+	ls := make([]*Limiter, 100000)
+	for b.Loop() {
+		for i := range ls {
+			ls[i] = ticker.NewLimiter(1000)
+		}
+		for _, l := range ls {
+			l.Stop()
+		}
+	}
+}
+
+func BenchmarkLimiter_io_100k(b *testing.B) {
+	ticker := NewTicker()
+	defer ticker.Stop()
+	ls := make([]*Limiter, 100000)
+	for i := range ls {
+		ls[i] = ticker.NewLimiter(1000000)
+	}
+	defer func() {
+		for _, l := range ls {
+			l.Stop()
+		}
+	}()
+	buf := make([]byte, 10)
+	r := &unlimitedReader{}
+	i := 0
+	for b.Loop() {
+		if _, err := ls[i].Reads.io(r.Read, buf); err != nil {
+			b.Fatal(err)
+		}
+		i = (i + 1) % len(ls)
+	}
+}
@@ -9,10 +9,7 @@ type Listener struct {
 
 func (l *Listener) Accept() (conn net.Conn, err error) {
 	if conn, err = l.Listener.Accept(); err == nil {
-		conn = &Conn{
-			Conn:    conn,
-			Limiter: l.Limiter,
-		}
+		conn = NewConn(conn, l.Limiter)
 	}
 	return
 }
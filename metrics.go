@@ -0,0 +1,120 @@
+package bwlimit
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"weak"
+)
+
+// A Registry holds named Limiters and serves their metrics over HTTP
+// in the Prometheus text exposition format.
+//
+// A registered Limiter is not kept reachable by the Registry, so it is
+// still stopped automatically once it is no longer otherwise used, and
+// then disappears from the metrics.
+type Registry struct {
+	mu       sync.Mutex // protects following
+	limiters map[string]weak.Pointer[Limiter]
+}
+
+// DefaultRegistry is the Registry used by Register and MetricsHandler.
+var DefaultRegistry = &Registry{}
+
+// Register adds l to DefaultRegistry under name.
+func Register(name string, l *Limiter) {
+	DefaultRegistry.Register(name, l)
+}
+
+// MetricsHandler returns an http.Handler serving the metrics for the
+// Limiters in DefaultRegistry.
+func MetricsHandler() http.Handler {
+	return DefaultRegistry
+}
+
+// Register adds l under name, replacing any Limiter already registered
+// under that name. Registering a nil Limiter removes name.
+func (r *Registry) Register(name string, l *Limiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if l == nil {
+		delete(r.limiters, name)
+		return
+	}
+	if r.limiters == nil {
+		r.limiters = make(map[string]weak.Pointer[Limiter])
+	}
+	r.limiters[name] = weak.Make(l)
+}
+
+// Limiters returns the registered Limiters that are still reachable, by name.
+func (r *Registry) Limiters() (limiters map[string]*Limiter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	limiters = make(map[string]*Limiter, len(r.limiters))
+	for name, wp := range r.limiters {
+		if l := wp.Value(); l != nil {
+			limiters[name] = l
+		} else {
+			delete(r.limiters, name)
+		}
+	}
+	return
+}
+
+// A metric describes one Prometheus metric family.
+type metric struct {
+	name  string
+	help  string
+	kind  string // "gauge" or "counter"
+	value func(op *Operation) float64
+}
+
+var metrics = []metric{
+	{"bwlimit_limit_bytes_per_second", "Bandwidth limit, zero if unlimited.", "gauge",
+		func(op *Operation) float64 { return float64(max(0, op.Limit.Load())) }},
+	{"bwlimit_rate_bytes_per_second", "Bandwidth used during the last second.", "gauge",
+		func(op *Operation) float64 { return float64(op.Rate.Load()) }},
+	{"bwlimit_bytes_total", "Bytes read or written.", "counter",
+		func(op *Operation) float64 { return float64(op.total.Load()) }},
+	{"bwlimit_throttled_seconds_total", "Time spent waiting for the bandwidth budget of this direction.", "counter",
+		func(op *Operation) float64 { return time.Duration(op.Throttled.Load()).Seconds() }},
+}
+
+// labelEscaper escapes Prometheus label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// ServeHTTP writes the metrics for all registered Limiters.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	limiters := r.Limiters()
+	names := make([]string, 0, len(limiters))
+	for name := range limiters {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, name := range names {
+			l := limiters[name]
+			for _, op := range []struct {
+				direction string
+				*Operation
+			}{{"read", l.Reads}, {"write", l.Writes}, {"total", l.Total}} {
+				fmt.Fprintf(bw, "%s{limiter=\"%s\",direction=\"%s\"} %g\n",
+					m.name, labelEscaper.Replace(name), op.direction, m.value(op.Operation))
+			}
+		}
+	}
+	fmt.Fprintf(bw, "# HELP bwlimit_active_conns Connections that have not been closed.\n# TYPE bwlimit_active_conns gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(bw, "bwlimit_active_conns{limiter=\"%s\"} %d\n", labelEscaper.Replace(name), limiters[name].ActiveConns())
+	}
+	_ = bw.Flush()
+}
@@ -0,0 +1,118 @@
+package bwlimit
+
+import (
+	"net"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestRegistry_ServeHTTP(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 100)
+		defer l.Stop()
+		other := ticker.NewLimiter()
+		defer other.Stop()
+
+		var reg Registry
+		reg.Register(`tenant "a"`, l)
+		reg.Register("other", other)
+		reg.Register("removed", other)
+		reg.Register("removed", nil)
+
+		if _, err := l.Writes.io(func(b []byte) (int, error) { return len(b), nil }, make([]byte, 30)); err != nil {
+			t.Fatal(err)
+		}
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		conn := NewConn(c1, l)
+		defer conn.Close()
+
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+			t.Error(ct)
+		}
+		body := rec.Body.String()
+		for _, line := range []string{
+			"# TYPE bwlimit_limit_bytes_per_second gauge",
+			`bwlimit_limit_bytes_per_second{limiter="tenant \"a\"",direction="write"} 100`,
+			`bwlimit_limit_bytes_per_second{limiter="tenant \"a\"",direction="read"} 0`,
+			`bwlimit_rate_bytes_per_second{limiter="tenant \"a\"",direction="write"} 20`,
+			"# TYPE bwlimit_bytes_total counter",
+			`bwlimit_bytes_total{limiter="tenant \"a\"",direction="write"} 30`,
+			`bwlimit_bytes_total{limiter="tenant \"a\"",direction="total"} 30`,
+			`bwlimit_bytes_total{limiter="other",direction="write"} 0`,
+			`bwlimit_throttled_seconds_total{limiter="tenant \"a\"",direction="write"} 0.2`,
+			`bwlimit_active_conns{limiter="tenant \"a\""} 1`,
+			`bwlimit_active_conns{limiter="other"} 0`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("missing %q", line)
+			}
+		}
+		if strings.Contains(body, "removed") {
+			t.Error("removed Limiter included")
+		}
+		if strings.Index(body, `limiter="other"`) > strings.Index(body, `limiter="tenant`) {
+			t.Error("not sorted by name")
+		}
+		if t.Failed() {
+			t.Log(body)
+		}
+	})
+}
+
+func TestRegistry_ServeHTTP_total(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 0, 100)
+		defer l.Stop()
+		var reg Registry
+		reg.Register("l", l)
+
+		if _, err := l.Writes.io(func(b []byte) (int, error) { return len(b), nil }, make([]byte, 30)); err != nil {
+			t.Fatal(err)
+		}
+		// Let the Ticker move the byte count into Count, which must not change bytes_total.
+		time.Sleep(time.Second)
+
+		rec := httptest.NewRecorder()
+		reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		body := rec.Body.String()
+		for _, line := range []string{
+			`bwlimit_bytes_total{limiter="l",direction="write"} 30`,
+			`bwlimit_bytes_total{limiter="l",direction="total"} 30`,
+			// The wait was caused by the combined limit.
+			`bwlimit_throttled_seconds_total{limiter="l",direction="write"} 0`,
+			`bwlimit_throttled_seconds_total{limiter="l",direction="total"} 0.2`,
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("missing %q", line)
+			}
+		}
+		if t.Failed() {
+			t.Log(body)
+		}
+	})
+}
+
+func TestRegistry_unreachable(t *testing.T) {
+	var reg Registry
+	func() {
+		reg.Register("gone", NewLimiter())
+	}()
+	for range 10 {
+		runtime.GC()
+		if len(reg.Limiters()) == 0 {
+			return
+		}
+	}
+	t.Error(reg.Limiters())
+}
@@ -1,7 +1,10 @@
 package bwlimit
 
 import (
+	"context"
+	"errors"
 	"io"
+	"os"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -9,29 +12,54 @@ import (
 
 const secparts = 10
 const interval = time.Second / secparts
-const batchsize = 4096
+const batchsize = 4096                   // smallest maximum grant size
+const batchparts = 8                     // slice budget is handed out in at least this many grants
+const pacewindow = 10 * time.Millisecond // largest burst allowed when pacing
 
+// ErrWouldThrottle is returned by non-blocking reads and writes when the
+// bandwidth budget for the current time slice is exhausted.
+var ErrWouldThrottle = errors.New("bwlimit: would throttle")
+
+// An Operation limits and measures bandwidth in one direction.
+//
+// Operations have no goroutines of their own. Budget for the current
+// time slice is computed lazily when it is needed, and the Ticker only
+// updates Rate and Count for Operations that have seen recent traffic,
+// so idle Operations cost neither goroutines nor wakeups.
 type Operation struct {
-	*Ticker              // Ticker we belong to
-	Limit   atomic.Int64 // bandwith limit in bytes/sec
-	Rate    atomic.Int64 // current rate in bytes/sec
-	Count   atomic.Int64 // number of bytes seen
-	avail   atomic.Int64 // refunded bytes from partially used grants
-	count   atomic.Int64
-	ch      <-chan int64
-	doneCh  chan struct{}
-	reader  bool
-	mu      sync.Mutex // protects following
-	stopCh  chan struct{}
+	*Ticker                // Ticker we belong to
+	Limit     atomic.Int64 // bandwith limit in bytes/sec
+	Rate      atomic.Int64 // current rate in bytes/sec
+	Count     atomic.Int64 // number of bytes seen
+	Pacing    atomic.Bool  // if true, spread budget evenly over time instead of per time slice
+	Burst     atomic.Int64 // bytes at the start of each Conn that bypass the limit
+	Throttled atomic.Int64 // nanoseconds spent waiting for this Operation's budget
+	parent    *Operation   // optional Operation whose budget we share
+	avail     atomic.Int64 // bytes left to grant in the current time slice
+	epoch     atomic.Int64 // Ticker tick that avail was computed for
+	count     atomic.Int64
+	total     atomic.Int64                  // bytes seen, only ever growing unlike Count+count
+	active    atomic.Bool                   // true while tracked by the Ticker
+	limitCh   atomic.Pointer[chan struct{}] // closed when SetLimit changes the limit
+	sampler   atomic.Pointer[sampler]       // if not nil, times writes for a Controller
+	doneCh    chan struct{}
+	reader    bool
+	seccount  int // protected by Ticker.opsMu
+	counts    [secparts]int64
+	mu        sync.Mutex // protects following
+	stopCh    chan struct{}
+	carry     int64     // remainder of limit/secparts for slice based refill
+	pacecarry int64     // remainder in byte·nanoseconds for pacing
+	paced     time.Time // when budget was last accrued while pacing
+	rampgen   int64     // incremented by SetLimit to cancel ongoing ramps
 }
 
 func NewOperation(t *Ticker, limits []int64, idx int) (op *Operation) {
-	ch := make(chan int64)
+	ch := make(chan struct{})
 	op = &Operation{
 		Ticker: t,
-		ch:     ch,
-		stopCh: make(chan struct{}),
-		doneCh: make(chan struct{}),
+		stopCh: ch,
+		doneCh: ch,
 		reader: idx == 0,
 	}
 	var limit int64
@@ -42,7 +70,7 @@ func NewOperation(t *Ticker, limits []int64, idx int) (op *Operation) {
 		}
 	}
 	op.Limit.Store(limit)
-	go op.run(ch)
+	op.epoch.Store(-1)
 	return
 }
 
@@ -53,111 +81,506 @@ func (op *Operation) Stop() {
 	op.mu.Unlock()
 	if ch != nil {
 		close(ch)
+		op.Ticker.untrack(op)
+		op.Count.Add(op.count.Swap(0))
 	}
-	<-op.doneCh
 }
 
-func (op *Operation) run(ch chan<- int64) {
-	defer func() {
-		close(ch)
-		op.Count.Add(op.count.Swap(0))
-		close(op.doneCh)
-	}()
-
+// SetLimit changes the bandwidth limit to limit bytes/sec. Unlike storing
+// to Limit, which takes effect in the next time slice, the budget left in
+// the current time slice is adjusted right away and reads and writes
+// waiting for budget are woken up.
+//
+// If ramp is positive and both the current and new limits are positive,
+// the limit instead moves linearly to the new limit over the ramp duration,
+// adjusted every time slice. Calling SetLimit again cancels any ongoing ramp.
+func (op *Operation) SetLimit(limit int64, ramp time.Duration) {
 	op.mu.Lock()
-	stopCh := op.stopCh
-	seccount := 0
-	counts := make([]int64, secparts)
-	carry := int64(0)
-	op.mu.Unlock()
+	defer op.mu.Unlock()
+	op.rampgen++
+	if from := op.Limit.Load(); ramp > 0 && from > 0 && limit > 0 {
+		op.rampto(op.rampgen, from, limit, time.Now(), ramp)
+	} else {
+		op.setlimit(limit)
+	}
+}
 
-	if stopCh != nil {
-		for {
-			var todo int64
-			if limit := op.Limit.Load(); limit > 0 {
-				carry += limit
-				todo = carry / secparts
-				carry = carry % secparts
-				todo += op.avail.Swap(0)
-			} else {
-				// Drop any accumulated state so that switching back to
-				// a positive limit cannot replay a burst of previously
-				// refunded bytes.
-				carry = 0
-				op.avail.Store(0)
+// rampto sets the limit for the current point of the ramp from from to to
+// that started at start and lasts for d, and schedules the next step.
+// Must hold op.mu.
+func (op *Operation) rampto(gen, from, to int64, start time.Time, d time.Duration) {
+	elapsed := time.Since(start)
+	if elapsed >= d || op.stopCh == nil {
+		op.setlimit(to)
+		return
+	}
+	op.setlimit(from + int64(float64(to-from)*float64(elapsed)/float64(d)))
+	time.AfterFunc(min(interval, d-elapsed), func() {
+		op.mu.Lock()
+		defer op.mu.Unlock()
+		if op.rampgen == gen {
+			op.rampto(gen, from, to, start, d)
+		}
+	})
+}
+
+// setlimit stores limit, adjusts the budget for the current time slice
+// and wakes up waiters. Must hold op.mu.
+func (op *Operation) setlimit(limit int64) {
+	old := op.Limit.Swap(limit)
+	if limit == old {
+		return
+	}
+	if limit > 0 {
+		budget := limit / secparts
+		if op.Pacing.Load() {
+			budget = paceburst(limit)
+		} else if old < 1 || op.epoch.Load() != op.Ticker.tick.Load() {
+			// budget for the current slice not yet computed
+			op.epoch.Store(-1)
+			budget = -1
+		} else if delta := budget - old/secparts; delta > 0 {
+			op.avail.Add(delta)
+			budget = -1
+		}
+		for budget >= 0 {
+			avail := op.avail.Load()
+			if avail <= budget || op.avail.CompareAndSwap(avail, budget) {
+				break
 			}
-			waitCh := op.WaitCh()
+		}
+	}
+	if ch := op.limitCh.Swap(nil); ch != nil {
+		close(*ch)
+	}
+}
+
+// changed returns a channel that is closed when SetLimit changes the limit.
+func (op *Operation) changed() <-chan struct{} {
+	for {
+		if ch := op.limitCh.Load(); ch != nil {
+			return *ch
+		}
+		ch := make(chan struct{})
+		if op.limitCh.CompareAndSwap(nil, &ch) {
+			return ch
+		}
+	}
+}
+
+// stopped returns true if either the Operation or it's Ticker is stopped.
+func (op *Operation) stopped() bool {
+	select {
+	case <-op.doneCh:
+		return true
+	case <-op.Ticker.doneCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// account adds n to the byte count and makes sure the
+// Ticker will update our metrics.
+func (op *Operation) account(n int) {
+	if n > 0 {
+		op.count.Add(int64(n))
+		op.total.Add(int64(n))
+		if !op.active.Swap(true) {
+			op.Ticker.track(op)
+		}
+		if op.parent != nil {
+			op.parent.account(n)
+		}
+	}
+}
+
+// limited returns true if the Operation or it's parent has a limit.
+func (op *Operation) limited() bool {
+	return op.Limit.Load() > 0 || (op.parent != nil && op.parent.Limit.Load() > 0)
+}
 
-		partialsecond:
+// effective returns the lowest limit applying to op, or zero if none.
+func (op *Operation) effective() (limit int64) {
+	limit = op.Limit.Load()
+	if p := op.parent; p != nil {
+		if plimit := p.Limit.Load(); plimit > 0 && (limit < 1 || plimit < limit) {
+			limit = plimit
+		}
+	}
+	return max(0, limit)
+}
+
+// update is called by the Ticker at the end of each time slice.
+// It returns false if there was no traffic during the last second.
+func (op *Operation) update() bool {
+	count := op.count.Swap(0)
+	op.Count.Add(count)
+	op.counts[op.seccount] = count
+	op.seccount++
+	if op.seccount >= secparts {
+		op.seccount = 0
+	}
+	var rate int64
+	for i := range secparts {
+		rate += op.counts[i]
+	}
+	op.Rate.Store(rate)
+	return rate != 0
+}
+
+// grantsize returns the largest grant handed out at once for limit.
+// High limits use large grants so that fast transfers aren't split into
+// many small reads or writes, while low limits use small grants so that
+// concurrent users of the Operation share the budget fairly.
+func grantsize(limit int64) int64 {
+	return max(batchsize, limit/(secparts*batchparts))
+}
+
+// paceburst returns the most budget that can accumulate while pacing.
+func paceburst(limit int64) int64 {
+	return max(1, limit/int64(time.Second/pacewindow))
+}
+
+// maxavail returns the most budget the Operation can have at once at limit.
+func (op *Operation) maxavail(limit int64) int64 {
+	if op.Pacing.Load() {
+		return paceburst(limit)
+	}
+	return (limit + secparts - 1) / secparts
+}
+
+// refill makes sure avail holds the budget for the current time slice.
+func (op *Operation) refill(limit int64) {
+	op.Ticker.wake()
+	if op.Pacing.Load() {
+		op.accrue(limit)
+	} else if tick := op.Ticker.tick.Load(); op.epoch.Load() != tick {
+		op.mu.Lock()
+		if op.epoch.Load() != tick {
+			op.carry += limit
+			budget := op.carry / secparts
+			op.carry = op.carry % secparts
 			for {
-				var limitCh chan<- int64
-				var batch int64
-				if todo > 0 {
-					limitCh = ch
-					batch = min(batchsize, todo)
-				}
-				select {
-				case <-stopCh:
-					return
-				case <-op.Ticker.doneCh:
-					return
-				case limitCh <- batch:
-					todo -= batch
-					todo += op.avail.Swap(0)
-				case <-waitCh:
-					break partialsecond
+				// Any budget not used in the previous slice is intentionally dropped.
+				// This prevents idle periods from accumulating burst capacity.
+				// Budget reserved in advance by Reserve is carried over as debt.
+				avail := op.avail.Load()
+				if op.avail.CompareAndSwap(avail, budget+min(0, avail)) {
+					break
 				}
 			}
+			op.epoch.Store(tick)
+		}
+		op.mu.Unlock()
+	}
+}
+
+// accrue adds budget for the time elapsed since the last call,
+// up to paceburst bytes.
+func (op *Operation) accrue(limit int64) {
+	now := time.Now()
+	burst := paceburst(limit)
+	// Elapsed time beyond what it takes to accrue burst bytes adds nothing,
+	// so cap it to keep the arithmetic from overflowing.
+	window := max(pacewindow, time.Duration(burst*int64(time.Second)/limit)+1)
+	op.mu.Lock()
+	elapsed := min(now.Sub(op.paced), window)
+	op.paced = now
+	op.pacecarry += int64(elapsed) * limit
+	add := op.pacecarry / int64(time.Second)
+	op.pacecarry = op.pacecarry % int64(time.Second)
+	for add > 0 {
+		avail := op.avail.Load()
+		if op.avail.CompareAndSwap(avail, min(avail+add, max(avail, burst))) {
+			break
+		}
+	}
+	op.mu.Unlock()
+	if op.epoch.Load() != -1 {
+		// make sure slice based refill starts afresh if pacing is turned off
+		op.epoch.Store(-1)
+	}
+}
 
-			// Any base budget not used in this slice is intentionally dropped.
-			// This prevents idle periods from accumulating burst capacity.
-			count := op.count.Swap(0)
-			op.Count.Add(count)
-			counts[seccount] = count
-			seccount++
-			if seccount >= secparts {
-				seccount = 0
+// pacewait returns how long to wait until a pacing Operation or
+// it's pacing parent has accrued a useful amount of budget,
+// or zero if none of them are exhausted.
+func (op *Operation) pacewait() (d time.Duration) {
+	for o := op; o != nil; o = o.parent {
+		if limit := o.Limit.Load(); limit > 0 && o.Pacing.Load() {
+			need := max(1, paceburst(limit)/batchparts)
+			if avail := o.avail.Load(); avail < need {
+				d = max(d, o.delayfor(need-avail, limit))
 			}
-			var rate int64
-			for i := range secparts {
-				rate += counts[i]
+		}
+	}
+	return
+}
+
+// delayfor returns how long it takes until n more bytes of budget is available.
+func (op *Operation) delayfor(n, limit int64) time.Duration {
+	if op.Pacing.Load() {
+		return time.Duration((n*int64(time.Second) + limit - 1) / limit)
+	}
+	perslice := max(1, limit/secparts)
+	return time.Duration((n+perslice-1)/perslice) * interval
+}
+
+// A throttle holds the settings for waiting for budget.
+type throttle struct {
+	block    bool            // wait for budget instead of returning ErrWouldThrottle
+	reader   bool            // fn reads, so return after a short read
+	waited   *atomic.Int64   // if not nil, time spent waiting is added to it
+	done     <-chan struct{} // if closed, stop waiting and fail with err()
+	err      func() error
+	deadline time.Time     // if not zero, stop waiting and fail with os.ErrDeadlineExceeded
+	stream   *atomic.Int64 // if not nil, bytes done so far by the stream, for Burst
+}
+
+// exhausted returns the Operation whose budget has run out,
+// which is op unless only it's parent is exhausted.
+func (op *Operation) exhausted() *Operation {
+	if p := op.parent; p != nil && p.Limit.Load() > 0 && p.avail.Load() < 1 {
+		if op.Limit.Load() < 1 || op.avail.Load() > 0 {
+			return p
+		}
+	}
+	return op
+}
+
+// wait blocks until more budget may be available, the limit is changed
+// using SetLimit, the Operation or it's Ticker is stopped, t.done is
+// closed or t.deadline passes.
+func (op *Operation) wait(waitCh <-chan struct{}, t *throttle) (err error) {
+	start := time.Now()
+	blamed := op.exhausted()
+	d := op.pacewait()
+	if !t.deadline.IsZero() {
+		until := time.Until(t.deadline)
+		if until <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		if d == 0 || until < d {
+			d = until
+		}
+	}
+	var timerCh <-chan time.Time
+	if d > 0 {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timerCh = timer.C
+	}
+	var parentCh <-chan struct{}
+	if op.parent != nil {
+		parentCh = op.parent.changed()
+	}
+	select {
+	case <-waitCh:
+	case <-op.changed():
+	case <-parentCh:
+	case <-timerCh:
+		if !t.deadline.IsZero() && !time.Now().Before(t.deadline) {
+			err = os.ErrDeadlineExceeded
+		}
+	case <-op.doneCh:
+	case <-op.Ticker.doneCh:
+	case <-t.done:
+		err = t.err()
+	}
+	waited := int64(time.Since(start))
+	blamed.Throttled.Add(waited)
+	if t.waited != nil {
+		t.waited.Add(waited)
+	}
+	return
+}
+
+// grant returns up to want bytes of budget from the current time slice,
+// or zero if the budget is exhausted.
+func (op *Operation) grant(limit, want int64) int64 {
+	op.refill(limit)
+	want = min(want, grantsize(limit))
+	for {
+		avail := op.avail.Load()
+		if avail < 1 {
+			return 0
+		}
+		n := min(avail, want)
+		if op.avail.CompareAndSwap(avail, avail-n) {
+			return n
+		}
+	}
+}
+
+// take returns up to want bytes of budget granted by both the
+// Operation and it's parent, or zero if either is exhausted.
+func (op *Operation) take(want int64) int64 {
+	limit := op.Limit.Load()
+	if limit > 0 {
+		want = op.grant(limit, want)
+	}
+	if p := op.parent; p != nil && want > 0 {
+		if plimit := p.Limit.Load(); plimit > 0 {
+			if got := p.grant(plimit, want); got < want {
+				if limit > 0 {
+					op.avail.Add(want - got)
+				}
+				want = got
 			}
-			op.Rate.Store(rate)
 		}
 	}
+	return want
+}
+
+// refund returns n bytes of unused budget to the Operation and it's parent.
+func (op *Operation) refund(n int64) {
+	if n > 0 {
+		if op.Limit.Load() > 0 {
+			op.avail.Add(n)
+		}
+		if p := op.parent; p != nil && p.Limit.Load() > 0 {
+			p.avail.Add(n)
+		}
+	}
+}
+
+// allow consumes n bytes of budget if they are available right now.
+func (op *Operation) allow(n int64) bool {
+	limit := op.Limit.Load()
+	if limit < 1 {
+		return true
+	}
+	if n > op.maxavail(limit) {
+		return false
+	}
+	op.refill(limit)
+	for {
+		avail := op.avail.Load()
+		if avail < n {
+			return false
+		}
+		if op.avail.CompareAndSwap(avail, avail-n) {
+			return true
+		}
+	}
+}
+
+// AllowN reports whether n bytes of budget are available right now,
+// and if so, consumes them. It never blocks. The bytes are not added
+// to Count or Rate.
+//
+// Budget is granted one time slice at a time, so if n is more than the
+// Operation or it's parent can have at once, which is a tenth of the Limit
+// or the pacing burst if Pacing is set, AllowN returns false right away
+// since it could never succeed. Burst does not apply to AllowN, so use
+// WaitN for larger n.
+//
+// If the Operation is unlimited, returns true. If the Operation or
+// it's Ticker is stopped, returns false.
+func (op *Operation) AllowN(n int64) bool {
+	if op.stopped() {
+		return false
+	}
+	if n < 1 {
+		return true
+	}
+	if !op.allow(n) {
+		return false
+	}
+	if op.parent != nil && !op.parent.allow(n) {
+		if op.Limit.Load() > 0 {
+			op.avail.Add(n)
+		}
+		return false
+	}
+	return true
+}
+
+// WaitN blocks until n bytes of budget have been granted, for use with
+// I/O that doesn't go through a Conn. The bytes are not added to Count or Rate.
+//
+// If ctx is done first, the budget granted so far is returned to the
+// Operation and ctx.Err() is returned. If the Operation or it's Ticker
+// is stopped, returns io.EOF. If the Operation is unlimited, returns
+// immediately.
+func (op *Operation) WaitN(ctx context.Context, n int64) (err error) {
+	var got int64
+	err = ctx.Err()
+	for got < n && err == nil {
+		if !op.limited() {
+			break
+		}
+		waitCh := op.WaitCh()
+		if op.stopped() {
+			err = io.EOF
+		} else if todo := op.take(n - got); todo > 0 {
+			got += todo
+		} else {
+			err = op.wait(waitCh, &throttle{done: ctx.Done(), err: ctx.Err})
+		}
+	}
+	if err != nil {
+		op.refund(got)
+	}
+	return
 }
 
 func (op *Operation) io(fn func([]byte) (int, error), b []byte) (n int, err error) {
-outer:
+	return op.doio(fn, b, &throttle{block: true, reader: op.reader})
+}
+
+// doio calls fn with as much of b as the bandwidth budget allows
+// until b is done, waiting for budget as directed by t.
+func (op *Operation) doio(fn func([]byte) (int, error), b []byte, t *throttle) (n int, err error) {
+	if s := op.sampler.Load(); s != nil && !t.reader {
+		fn = s.wrap(fn)
+	}
+	if t.stream != nil {
+		// The first Burst bytes of a stream bypass the limit.
+		if free := op.Burst.Load() - t.stream.Load(); free > 0 && len(b) > 0 {
+			todo := int(min(int64(len(b)), free))
+			n, err = fn(b[:todo])
+			op.account(n)
+			b = b[n:]
+			if err != nil || t.reader || n < todo {
+				b = nil
+			}
+		}
+	}
+
 	for len(b) > 0 && err == nil {
 		var done int
-		if op.Limit.Load() < 1 {
+		if !op.limited() {
 			done, err = fn(b)
 			n += done
-			op.count.Add(int64(done))
+			op.account(done)
 			return
 		}
-		select {
-		case batch, ok := <-op.ch:
+		waitCh := op.WaitCh()
+		if op.stopped() {
 			err = io.EOF
-			if ok {
-				todo := min(int64(len(b)), batch)
-				done, err = fn(b[:todo])
-				op.avail.Add(batch - int64(done))
-				if done > 0 {
-					op.count.Add(int64(done))
-					n += int(done)
-					b = b[done:]
-				}
-				if op.reader && int64(done) < todo {
-					break outer
-				}
+			break
+		}
+		if todo := op.take(int64(len(b))); todo > 0 {
+			done, err = fn(b[:todo])
+			op.refund(todo - int64(done))
+			if done > 0 {
+				op.account(done)
+				n += done
+				b = b[done:]
+			}
+			if t.reader && int64(done) < todo {
+				break
 			}
-		case <-op.WaitCh():
+		} else if !t.block {
+			err = ErrWouldThrottle
+		} else {
+			err = op.wait(waitCh, t)
 		}
 	}
 
-	if op.reader && n > 0 && err == io.EOF {
+	if t.reader && n > 0 && err == io.EOF {
 		err = nil
 	}
 	return
@@ -2,6 +2,8 @@ package bwlimit
 
 import (
 	"bytes"
+	"context"
+	"io"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -346,6 +348,269 @@ func TestOperation_read_noBurstAcrossUnlimitedTransition(t *testing.T) {
 	})
 }
 
+// maxWindow returns the largest number of bytes fn was called
+// with during any window of length d.
+func maxWindow(times []time.Time, sizes []int, d time.Duration) (most int) {
+	for i := range times {
+		var sum int
+		for j := i; j < len(times) && times[j].Sub(times[i]) < d; j++ {
+			sum += sizes[j]
+		}
+		most = max(most, sum)
+	}
+	return
+}
+
+func TestOperation_Pacing(t *testing.T) {
+	const limit = 10000
+	for _, pacing := range []bool{false, true} {
+		synctest.Test(t, func(t *testing.T) {
+			ticker := NewTicker()
+			defer ticker.Stop()
+			l := ticker.NewLimiter(limit)
+			defer l.Stop()
+			l.Reads.Pacing.Store(pacing)
+
+			var times []time.Time
+			var sizes []int
+			r := bytes.NewReader(make([]byte, limit))
+			fn := func(b []byte) (int, error) {
+				times = append(times, time.Now())
+				sizes = append(sizes, len(b))
+				return r.Read(b)
+			}
+
+			now := time.Now()
+			n, err := l.Reads.io(fn, make([]byte, limit))
+			if n != limit || err != nil {
+				t.Fatal(n, err)
+			}
+			if elapsed := time.Since(now); elapsed < 900*time.Millisecond || elapsed > 1100*time.Millisecond {
+				t.Error(pacing, elapsed)
+			}
+
+			// At 10000 bytes/sec, 10ms is 100 bytes.
+			most := maxWindow(times, sizes, 10*time.Millisecond)
+			if pacing && most > 200 {
+				t.Errorf("paced burst of %d bytes in 10ms", most)
+			}
+			if !pacing && most < limit/secparts {
+				t.Errorf("unpaced burst of only %d bytes in 10ms", most)
+			}
+		})
+	}
+}
+
+func TestOperation_Pacing_lowRate(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(50)
+		defer l.Stop()
+		l.Reads.Pacing.Store(true)
+
+		now := time.Now()
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 100)).Read, make([]byte, 100))
+		if n != 100 || err != nil {
+			t.Fatal(n, err)
+		}
+		// 100 bytes at 50 bytes/sec, one byte every 20ms.
+		if elapsed := time.Since(now); elapsed < 1900*time.Millisecond || elapsed > 2100*time.Millisecond {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestOperation_Pacing_off(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(1000)
+		defer l.Stop()
+		l.Reads.Pacing.Store(true)
+
+		// Paced reads leave a remainder that must not become slice budget.
+		for range 3 {
+			if n, err := l.Reads.io(bytes.NewReader(make([]byte, 7)).Read, make([]byte, 7)); n != 7 || err != nil {
+				t.Fatal(n, err)
+			}
+			time.Sleep(time.Millisecond / 3)
+		}
+		l.Reads.Pacing.Store(false)
+
+		now := time.Now()
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 2000)).Read, make([]byte, 2000))
+		if n != 2000 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed < 1800*time.Millisecond || elapsed > 2100*time.Millisecond {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestOperation_AllowN(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100, 0)
+		defer l.Stop()
+
+		if !l.Writes.AllowN(1000) {
+			t.Error("unlimited should allow")
+		}
+		if l.Reads.AllowN(11) {
+			t.Error("allowed more than the slice budget")
+		}
+		if !l.Reads.AllowN(10) {
+			t.Error("did not allow the slice budget")
+		}
+		if l.Reads.AllowN(1) {
+			t.Error("allowed after budget exhausted")
+		}
+		<-l.WaitCh()
+		if !l.Reads.AllowN(1) {
+			t.Error("did not allow in next slice")
+		}
+		l.Total.Limit.Store(50)
+		<-l.WaitCh()
+		if l.Reads.AllowN(6) {
+			t.Error("allowed more than the parent slice budget")
+		}
+		if !l.Reads.AllowN(5) {
+			t.Error("did not allow the parent slice budget")
+		}
+		l.Stop()
+		if l.Writes.AllowN(1) {
+			t.Error("allowed after Stop")
+		}
+	})
+}
+
+func TestOperation_WaitN(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		now := time.Now()
+		if err := l.Reads.WaitN(t.Context(), 300); err != nil {
+			t.Fatal(err)
+		}
+		// 300 bytes at 100 bytes/sec should take about 3 seconds.
+		if elapsed := time.Since(now); elapsed < 2*time.Second || elapsed > 4*time.Second {
+			t.Error(elapsed)
+		}
+		if n := l.Reads.count.Load(); n != 0 {
+			t.Error(n)
+		}
+	})
+}
+
+func TestOperation_WaitN_cancel(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		ctx, cancel := context.WithCancel(t.Context())
+		errCh := make(chan error)
+		go func() {
+			errCh <- l.Reads.WaitN(ctx, 1000)
+		}()
+
+		for range 3 {
+			<-l.WaitCh()
+		}
+		synctest.Wait()
+		cancel()
+		if err := <-errCh; err != context.Canceled {
+			t.Fatal(err)
+		}
+
+		// The 40 bytes granted so far must have been returned.
+		if avail := l.Reads.avail.Load(); avail != 40 {
+			t.Error(avail)
+		}
+	})
+}
+
+func TestOperation_WaitN_stopped(t *testing.T) {
+	l := NewLimiter(100)
+	l.Stop()
+	if err := l.Reads.WaitN(t.Context(), 1000); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+func TestOperation_SetLimit(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		// Raising the limit wakes up waiters right away.
+		now := time.Now()
+		errCh := make(chan error)
+		go func() {
+			errCh <- l.Reads.WaitN(t.Context(), 1000)
+		}()
+		time.Sleep(interval / 2)
+		synctest.Wait()
+		l.Reads.SetLimit(100_000, 0)
+		if err := <-errCh; err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(now); elapsed != interval/2 {
+			t.Error(elapsed)
+		}
+
+		// Lowering the limit drops the budget left in the current slice.
+		l.Reads.SetLimit(100, 0)
+		if avail := l.Reads.avail.Load(); avail != 10 {
+			t.Error(avail)
+		}
+		if l.Reads.AllowN(11) {
+			t.Error("allowed more than the new limit")
+		}
+	})
+}
+
+func TestOperation_SetLimit_ramp(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		l.Reads.SetLimit(1100, time.Second)
+		if limit := l.Reads.Limit.Load(); limit != 100 {
+			t.Error(limit)
+		}
+		time.Sleep(time.Second / 2)
+		synctest.Wait()
+		if limit := l.Reads.Limit.Load(); limit != 600 {
+			t.Error(limit)
+		}
+
+		// A new SetLimit cancels the ramp.
+		l.Reads.SetLimit(50, 0)
+		time.Sleep(time.Second)
+		if limit := l.Reads.Limit.Load(); limit != 50 {
+			t.Error(limit)
+		}
+
+		l.Reads.SetLimit(150, time.Second)
+		time.Sleep(2 * time.Second)
+		if limit := l.Reads.Limit.Load(); limit != 150 {
+			t.Error(limit)
+		}
+	})
+}
+
 func TestOperation_write_rate(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		ticker := NewTicker()
@@ -371,3 +636,59 @@ func TestOperation_write_rate(t *testing.T) {
 		}
 	})
 }
+
+func TestOperation_io_grantAdaptsToLimit(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(1000, 100_000_000_000/8)
+		defer l.Stop()
+
+		var calls int
+		fn := func(b []byte) (int, error) {
+			calls++
+			return len(b), nil
+		}
+
+		// High limits use a single grant for the whole buffer.
+		if n, err := l.Writes.io(fn, make([]byte, 64*1024)); n != 64*1024 || err != nil {
+			t.Fatal(n, err)
+		}
+		if calls != 1 {
+			t.Error(calls)
+		}
+
+		// Low limits are capped by the slice budget.
+		calls = 0
+		if n, err := l.Reads.io(fn, make([]byte, 200)); n != 200 || err != nil {
+			t.Fatal(n, err)
+		}
+		if calls != 2 {
+			t.Error(calls)
+		}
+	})
+}
+
+func benchmarkOperation_io(b *testing.B, limit int64) {
+	ticker := NewTicker()
+	defer ticker.Stop()
+	l := ticker.NewLimiter(limit)
+	defer l.Stop()
+
+	r := &unlimitedReader{}
+	buf := make([]byte, 64*1024)
+	b.SetBytes(int64(len(buf)))
+	for b.Loop() {
+		if _, err := l.Reads.io(r.Read, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkOperation_io_unlimited(b *testing.B) {
+	benchmarkOperation_io(b, 0)
+}
+
+func BenchmarkOperation_io_100Gbit(b *testing.B) {
+	benchmarkOperation_io(b, 100_000_000_000/8)
+}
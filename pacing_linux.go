@@ -0,0 +1,28 @@
+package bwlimit
+
+import (
+	"errors"
+	"math"
+	"net"
+	"syscall"
+)
+
+const soMaxPacingRate = 47 // SO_MAX_PACING_RATE
+
+// setPacingRate sets SO_MAX_PACING_RATE for the TCP socket underlying conn
+// to rate bytes/sec, or removes the limit if rate is zero.
+func setPacingRate(conn net.Conn, rate int64) (err error) {
+	var rc syscall.RawConn
+	if rc, err = rawConn(conn, errors.ErrUnsupported); err == nil {
+		val := uint32(math.MaxUint32) // unlimited
+		if rate > 0 {
+			val = uint32(min(rate, math.MaxUint32-1))
+		}
+		if e := rc.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soMaxPacingRate, int(int32(val)))
+		}); e != nil {
+			err = e
+		}
+	}
+	return
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package bwlimit
+
+import (
+	"errors"
+	"net"
+)
+
+func setPacingRate(conn net.Conn, rate int64) error {
+	return errors.ErrUnsupported
+}
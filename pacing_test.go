@@ -0,0 +1,99 @@
+package bwlimit
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestLimiter_KernelPacing(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_MAX_PACING_RATE requires Linux")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+
+	l := NewLimiter(0, 1000)
+	defer l.Stop()
+	l.KernelPacing.Store(true)
+	conn, err := l.Wrap(nil).DialContext(t.Context(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := conn.(*Conn)
+
+	// The kernel shapes the writes, so they are buffered without waiting.
+	now := time.Now()
+	if n, err := c.Write(make([]byte, 10_000)); n != 10_000 || err != nil {
+		t.Fatal(n, err)
+	}
+	if elapsed := time.Since(now); elapsed > time.Second {
+		t.Error(elapsed)
+	}
+	if n := l.Writes.count.Load() + l.Writes.Count.Load(); n != 10_000 {
+		t.Error(n)
+	}
+	if info, err := c.TCPInfo(); err != nil || info.MaxPacingRate != 1000 {
+		t.Error(info.MaxPacingRate, err)
+	}
+
+	// Changes to the limit are applied on the next write.
+	l.Writes.Limit.Store(2000)
+	if _, err = c.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := c.TCPInfo(); info.MaxPacingRate != 2000 {
+		t.Error(info.MaxPacingRate)
+	}
+
+	l.KernelPacing.Store(false)
+	l.Writes.Limit.Store(0)
+	if _, err = c.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := c.TCPInfo(); info.MaxPacingRate == 2000 {
+		t.Error(info.MaxPacingRate)
+	}
+}
+
+func TestLimiter_KernelPacing_fallback(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 100)
+		defer l.Stop()
+		l.KernelPacing.Store(true)
+
+		c1, c2 := net.Pipe()
+		defer c2.Close()
+		go func() {
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		conn := NewConn(c1, l)
+		defer conn.Close()
+
+		// net.Pipe has no socket, so the Operation shapes the writes.
+		if n, err := conn.Write(make([]byte, 30)); n != 30 || err != nil {
+			t.Fatal(n, err)
+		}
+		if stats := conn.Stats(); stats.Throttled != 2*interval {
+			t.Error(stats.Throttled)
+		}
+		if pacing := conn.pacing.Load(); pacing != -1 {
+			t.Error(pacing)
+		}
+	})
+}
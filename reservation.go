@@ -0,0 +1,73 @@
+package bwlimit
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// A Reservation holds bandwidth budget reserved in advance from an Operation.
+type Reservation struct {
+	ops      []*Operation // limited Operations the budget was taken from
+	n        int64
+	ok       bool
+	due      time.Time
+	canceled atomic.Bool
+}
+
+// Reserve reserves n bytes of budget and returns a Reservation telling
+// how long the caller must wait before using them. Budget is taken from
+// the current time slice, and if that isn't enough, from the following
+// slices, which delays other users of the Operation accordingly.
+// The bytes are not added to Count or Rate.
+//
+// If the Operation is unlimited, the Reservation has no delay.
+// If the Operation or it's Ticker is stopped, the Reservation is not OK.
+func (op *Operation) Reserve(n int64) (r *Reservation) {
+	now := time.Now()
+	r = &Reservation{n: n, due: now}
+	if r.ok = !op.stopped(); r.ok && n > 0 {
+		for o := op; o != nil; o = o.parent {
+			if due := o.reserve(now, n); !due.IsZero() {
+				r.ops = append(r.ops, o)
+				if due.After(r.due) {
+					r.due = due
+				}
+			}
+		}
+	}
+	return
+}
+
+// reserve takes n bytes of budget and returns when they are available,
+// or the zero time if the Operation is unlimited.
+func (op *Operation) reserve(now time.Time, n int64) (due time.Time) {
+	if limit := op.Limit.Load(); limit > 0 {
+		op.refill(limit)
+		due = now
+		if left := op.avail.Add(-n); left < 0 {
+			due = due.Add(op.delayfor(-left, limit))
+		}
+	}
+	return
+}
+
+// OK returns false if the Operation was stopped when Reserve was called.
+func (r *Reservation) OK() bool {
+	return r.ok
+}
+
+// Delay returns how long to wait from now until the reserved bytes may be used.
+// It may overestimate the wait by up to one time slice.
+func (r *Reservation) Delay() time.Duration {
+	return max(0, time.Until(r.due))
+}
+
+// Cancel returns the reserved budget to the Operation, unless the
+// Reservation is already due. Calling Cancel more than once has no effect.
+func (r *Reservation) Cancel() {
+	if time.Now().Before(r.due) && !r.canceled.Swap(true) {
+		for _, op := range r.ops {
+			op.avail.Add(r.n)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package bwlimit
+
+import (
+	"bytes"
+	"testing"
+	"testing/synctest"
+	"time"
+)
+
+func TestOperation_Reserve(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		// 10 bytes from this slice, 25 bytes from the next three.
+		r := l.Reads.Reserve(35)
+		if !r.OK() {
+			t.Fatal("not OK")
+		}
+		if d := r.Delay(); d != 3*interval {
+			t.Error(d)
+		}
+
+		now := time.Now()
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 1)).Read, make([]byte, 1))
+		if n != 1 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed < 2*interval || elapsed > 3*interval {
+			t.Error(elapsed)
+		}
+		if d := r.Delay(); d > interval {
+			t.Error(d)
+		}
+	})
+}
+
+func TestOperation_Reserve_Cancel(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+
+		r := l.Reads.Reserve(1000)
+		r.Cancel()
+		r.Cancel()
+
+		now := time.Now()
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 10)).Read, make([]byte, 10))
+		if n != 10 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != 0 {
+			t.Error(elapsed)
+		}
+	})
+}
+
+func TestOperation_Reserve_unlimited_stopped(t *testing.T) {
+	l := NewLimiter()
+	if r := l.Reads.Reserve(1000); !r.OK() || r.Delay() != 0 {
+		t.Error(r.OK(), r.Delay())
+	}
+	l.Stop()
+	if r := l.Reads.Reserve(1000); r.OK() {
+		t.Error("OK after Stop")
+	}
+}
+
+func TestOperation_Reserve_Pacing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(10000)
+		defer l.Stop()
+		l.Reads.Pacing.Store(true)
+
+		// 100 bytes accrued in the first 10ms, the rest at 10 bytes/ms.
+		if d := l.Reads.Reserve(200).Delay(); d != 10*time.Millisecond {
+			t.Error(d)
+		}
+	})
+}
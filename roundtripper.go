@@ -0,0 +1,46 @@
+package bwlimit
+
+import (
+	"io"
+	"net/http"
+)
+
+// RoundTripper is an http.RoundTripper that bandwidth limits request
+// and response bodies using the Limiter carried by the request context,
+// see WithLimiter. Requests without a Limiter are not limited.
+//
+// Since only the bodies are limited, it works with any connection, including
+// pooled keep-alive connections dialed for another request. Headers and
+// protocol overhead are not limited or counted. Don't also dial with a
+// Dialer using the same Limiter, or the body bytes are counted twice.
+type RoundTripper struct {
+	http.RoundTripper // underlying http.RoundTripper, if nil we use http.DefaultTransport
+}
+
+func (rt *RoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	next := rt.RoundTripper
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	l := LimiterFromContext(req.Context())
+	if l == nil {
+		return next.RoundTrip(req)
+	}
+	ctx := req.Context()
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(ctx)
+		req.Body = newBody(ctx, req.Body, l.Writes)
+		if getBody := req.GetBody; getBody != nil {
+			req.GetBody = func() (rc io.ReadCloser, err error) {
+				if rc, err = getBody(); err == nil {
+					rc = newBody(ctx, rc, l.Writes)
+				}
+				return
+			}
+		}
+	}
+	if resp, err = next.RoundTrip(req); err == nil {
+		resp.Body = newBody(ctx, resp.Body, l.Reads)
+	}
+	return
+}
@@ -0,0 +1,117 @@
+package bwlimit
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/synctest"
+)
+
+func TestLimiterFromContext(t *testing.T) {
+	l := NewLimiter()
+	defer l.Stop()
+	if got := LimiterFromContext(context.Background()); got != nil {
+		t.Error(got)
+	}
+	if got := LimiterFromContext(WithLimiter(context.Background(), l)); got != l {
+		t.Error(got)
+	}
+}
+
+func TestRoundTripper(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(w, r.Body)
+	}))
+	defer srv.Close()
+
+	tp := srv.Client().Transport.(*http.Transport).Clone()
+	defer tp.CloseIdleConnections()
+	client := &http.Client{Transport: &RoundTripper{RoundTripper: tp}}
+
+	post := func(l *Limiter, body string) {
+		t.Helper()
+		ctx := t.Context()
+		if l != nil {
+			ctx = WithLimiter(ctx, l)
+		}
+		req, err := http.NewRequestWithContext(ctx, "POST", srv.URL, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if b, err := io.ReadAll(resp.Body); string(b) != body || err != nil {
+			t.Error(string(b), err)
+		}
+	}
+
+	l1 := NewLimiter()
+	defer l1.Stop()
+	l2 := NewLimiter()
+	defer l2.Stop()
+
+	// The same keep-alive connection is used for all requests,
+	// but each is counted by it's own Limiter.
+	post(l1, "Hello world!")
+	post(nil, "unlimited")
+	post(l2, "Hello")
+	for _, x := range []struct {
+		l *Limiter
+		n int64
+	}{{l1, 12}, {l2, 5}} {
+		if n := x.l.Writes.count.Load() + x.l.Writes.Count.Load(); n != x.n {
+			t.Error(n)
+		}
+		if n := x.l.Reads.count.Load() + x.l.Reads.Count.Load(); n != x.n {
+			t.Error(n)
+		}
+	}
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestRoundTripper_streamingBody(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(0, 1000)
+		defer l.Stop()
+
+		pr, pw := io.Pipe()
+		defer pw.Close()
+		go func() {
+			_, _ = pw.Write([]byte("hello"))
+		}()
+
+		// A read returns what is available instead of waiting to fill the buffer.
+		rt := &RoundTripper{RoundTripper: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			buf := make([]byte, 32)
+			if n, err := req.Body.Read(buf); string(buf[:n]) != "hello" || err != nil {
+				t.Error(n, err)
+			}
+			return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+		})}
+		req, err := http.NewRequestWithContext(WithLimiter(t.Context(), l), "POST", "http://example.com/", pr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if n := l.Writes.count.Load() + l.Writes.Count.Load(); n != 5 {
+			t.Error(n)
+		}
+	})
+}
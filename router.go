@@ -0,0 +1,185 @@
+package bwlimit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"weak"
+)
+
+// A Router is a ContextDialer that bandwidth limits each connection with
+// a Limiter chosen by the dialed address.
+//
+// Routes are matched in the order they were added, and connections to
+// addresses matching no route are not limited by the Router. For a global
+// cap on top of the per-route limits, set ContextDialer to a Dialer for the
+// global Limiter, for example from Limiter.Wrap. A route Limiter that already
+// limits ContextDialer is not applied twice.
+type Router struct {
+	ContextDialer            // ContextDialer we wrap, if nil we use DefaultNetDialer
+	mu            sync.Mutex // protects following
+	routes        []*route
+}
+
+// A route matches dialed addresses to a Limiter.
+type route struct {
+	host   string       // host name pattern, unused if prefix is valid
+	prefix netip.Prefix // IP addresses to match, if valid
+	port   string       // port to match, or "*"
+	l      *Limiter
+	newFn  func(host string) *Limiter
+	cache  map[string]weak.Pointer[Limiter] // Limiters from newFn by host
+}
+
+// Handle makes connections to addresses matching pattern use l.
+//
+// A pattern is a host with an optional port, where the host is either a
+// name that may contain shell wildcards as in path.Match, an IP address, or
+// a CIDR prefix, and the port is a number or "*". Examples are "*.example.com",
+// "example.com:443", "*:443", "192.0.2.1", "10.0.0.0/8" and "[2001:db8::/32]:80".
+// Names only match names and prefixes only match IP addresses; the dialed
+// address is not resolved.
+func (r *Router) Handle(pattern string, l *Limiter) (err error) {
+	return r.add(pattern, l, nil)
+}
+
+// HandleFunc makes connections to addresses matching pattern use a
+// Limiter per host, created by calling fn with the host the first time it
+// is dialed. The host is passed in lower case, and IP addresses without
+// any IPv6 zone, so that different spellings of a host share a Limiter. The Limiter is reused for as long as it is reachable, so
+// all connections to the same host share it. If fn returns nil,
+// connections to the host are not limited.
+//
+// See Handle for the pattern syntax.
+func (r *Router) HandleFunc(pattern string, fn func(host string) *Limiter) (err error) {
+	return r.add(pattern, nil, fn)
+}
+
+func (r *Router) add(pattern string, l *Limiter, fn func(host string) *Limiter) (err error) {
+	var rt *route
+	if rt, err = parseRoute(pattern); err == nil {
+		rt.l = l
+		rt.newFn = fn
+		if fn != nil {
+			rt.cache = make(map[string]weak.Pointer[Limiter])
+		}
+		r.mu.Lock()
+		r.routes = append(r.routes, rt)
+		r.mu.Unlock()
+	}
+	return
+}
+
+// parseRoute parses a route pattern as described for Router.Handle.
+func parseRoute(pattern string) (rt *route, err error) {
+	rt = &route{host: pattern, port: "*"}
+	if prefix, e := netip.ParsePrefix(pattern); e == nil {
+		rt.prefix = prefix.Masked()
+		return
+	}
+	if host, port, e := net.SplitHostPort(pattern); e == nil {
+		rt.host = host
+		rt.port = port
+	}
+	if rt.port != "*" {
+		if _, e := strconv.ParseUint(rt.port, 10, 16); e != nil {
+			return nil, fmt.Errorf("bwlimit: invalid port in route pattern %q", pattern)
+		}
+	}
+	if rt.host == "" {
+		rt.host = "*"
+	}
+	if prefix, e := netip.ParsePrefix(rt.host); e == nil {
+		rt.prefix = prefix.Masked()
+	} else if addr, e := netip.ParseAddr(rt.host); e == nil {
+		rt.prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+	} else {
+		rt.host = strings.ToLower(rt.host)
+		if _, e := path.Match(rt.host, ""); e != nil {
+			return nil, fmt.Errorf("bwlimit: invalid host in route pattern %q", pattern)
+		}
+	}
+	return
+}
+
+// match returns true if the route matches host, as returned
+// by canonicalHost, and port.
+func (rt *route) match(host, port string) bool {
+	if rt.port != "*" && rt.port != port {
+		return false
+	}
+	if rt.prefix.IsValid() {
+		addr, err := netip.ParseAddr(host)
+		return err == nil && rt.prefix.Contains(addr)
+	}
+	ok, _ := path.Match(rt.host, host)
+	return ok
+}
+
+// canonicalHost returns host in lower case, or if it is an IP address,
+// without any IPv6 zone and with IPv4-mapped IPv6 addresses unmapped.
+func canonicalHost(host string) string {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return addr.WithZone("").Unmap().String()
+	}
+	return strings.ToLower(host)
+}
+
+// limiter returns the Limiter to use for host. Must hold Router.mu.
+func (rt *route) limiter(r *Router, host string) (l *Limiter) {
+	if l = rt.l; l == nil && rt.newFn != nil {
+		if l = rt.cache[host].Value(); l == nil {
+			if l = rt.newFn(host); l != nil {
+				wp := weak.Make(l)
+				rt.cache[host] = wp
+				runtime.AddCleanup(l, func(host string) {
+					r.mu.Lock()
+					defer r.mu.Unlock()
+					if rt.cache[host] == wp {
+						delete(rt.cache, host)
+					}
+				}, host)
+			}
+		}
+	}
+	return
+}
+
+// Select returns the Limiter for the first route matching address,
+// or nil if there is none.
+func (r *Router) Select(address string) (l *Limiter) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = canonicalHost(host)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rt := range r.routes {
+		if rt.match(host, port) {
+			return rt.limiter(r, host)
+		}
+	}
+	return
+}
+
+func (r *Router) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	cd := r.ContextDialer
+	if cd == nil {
+		cd = DefaultNetDialer
+	}
+	if l := r.Select(address); l != nil {
+		cd = l.Wrap(cd)
+	}
+	return cd.DialContext(ctx, network, address)
+}
+
+func (r *Router) Dial(network string, address string) (net.Conn, error) {
+	return r.DialContext(context.Background(), network, address)
+}
@@ -0,0 +1,140 @@
+package bwlimit
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRouter_Select(t *testing.T) {
+	l := map[string]*Limiter{}
+	var r Router
+	for _, pattern := range []string{
+		"*.example.com",
+		"example.com:443",
+		"10.0.0.0/8",
+		"[2001:db8::/32]:80",
+		"192.0.2.1",
+		"*:8080",
+	} {
+		l[pattern] = NewLimiter()
+		defer l[pattern].Stop()
+		if err := r.Handle(pattern, l[pattern]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for address, want := range map[string]string{
+		"www.example.com:80":   "*.example.com",
+		"a.b.EXAMPLE.com:80":   "*.example.com",
+		"example.com:443":      "example.com:443",
+		"example.com:80":       "",
+		"10.1.2.3:22":          "10.0.0.0/8",
+		"[::ffff:10.1.2.3]:22": "10.0.0.0/8",
+		"[2001:db8::1]:80":     "[2001:db8::/32]:80",
+		"[2001:db8::1]:81":     "",
+		"192.0.2.1":            "192.0.2.1",
+		"192.0.2.2:8080":       "*:8080",
+		"example.org:80":       "",
+	} {
+		if got := r.Select(address); got != l[want] {
+			t.Errorf("%q: got %p, want %q", address, got, want)
+		}
+	}
+
+	for _, pattern := range []string{"example.com:http", "[a-:80", "host:99999"} {
+		if err := r.Handle(pattern, nil); err == nil {
+			t.Error(pattern)
+		}
+	}
+}
+
+func TestRouter_HandleFunc(t *testing.T) {
+	var r Router
+	var created []string
+	if err := r.HandleFunc("*", func(host string) *Limiter {
+		created = append(created, host)
+		if host == "unlimited" {
+			return nil
+		}
+		return NewLimiter(100)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	a := r.Select("a:80")
+	defer a.Stop()
+	b := r.Select("b:443")
+	defer b.Stop()
+	if a == nil || b == nil || a == b {
+		t.Fatal(a, b)
+	}
+	if r.Select("a:443") != a {
+		t.Error("not reused")
+	}
+	if r.Select("A:443") != a {
+		t.Error("not reused for upper case host")
+	}
+	c := r.Select("[fe80::1%eth0]:80")
+	defer c.Stop()
+	if c == nil || r.Select("[FE80::1%eth1]:443") != c {
+		t.Error("not reused for IPv6 zone")
+	}
+	if r.Select("unlimited:80") != nil {
+		t.Error("not nil")
+	}
+	if len(created) != 4 || created[2] != "fe80::1" {
+		t.Error(created)
+	}
+}
+
+func TestRouter_DialContext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("Hello world!"))
+			_ = conn.Close()
+		}
+	}()
+
+	global := NewLimiter()
+	defer global.Stop()
+	local := NewLimiter()
+	defer local.Stop()
+
+	r := &Router{ContextDialer: global.Wrap(nil)}
+	if err = r.Handle("127.0.0.0/8", local); err != nil {
+		t.Fatal(err)
+	}
+	// global is already applied by ContextDialer, so it isn't counted twice.
+	if err = r.Handle("*", global); err != nil {
+		t.Fatal(err)
+	}
+
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	for _, address := range []string{ln.Addr().String(), net.JoinHostPort("localhost", port)} {
+		conn, err := r.DialContext(t.Context(), "tcp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := io.ReadAll(conn); string(b) != "Hello world!" || err != nil {
+			t.Error(string(b), err)
+		}
+		_ = conn.Close()
+	}
+
+	if n := local.Reads.count.Load() + local.Reads.Count.Load(); n != 12 {
+		t.Error(n)
+	}
+	if n := global.Reads.count.Load() + global.Reads.Count.Load(); n != 24 {
+		t.Error(n)
+	}
+}
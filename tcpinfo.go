@@ -0,0 +1,61 @@
+package bwlimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// ErrNoTCPInfo is returned by Conn.TCPInfo on platforms other than Linux
+// and for connections that are not TCP.
+var ErrNoTCPInfo = fmt.Errorf("bwlimit: TCP info: %w", errors.ErrUnsupported)
+
+// TCPInfo holds kernel statistics for a TCP connection.
+type TCPInfo struct {
+	RTT           time.Duration // smoothed round-trip time
+	RTTVar        time.Duration // round-trip time variance
+	MinRTT        time.Duration // lowest round-trip time seen
+	SndMSS        uint32        // sender maximum segment size
+	SndCwnd       uint32        // congestion window in segments
+	Retransmits   uint32        // total number of retransmitted segments
+	Lost          uint32        // segments currently considered lost
+	PacingRate    uint64        // current pacing rate in bytes/sec
+	MaxPacingRate uint64        // SO_MAX_PACING_RATE in bytes/sec, all ones if unlimited
+	DeliveryRate  uint64        // most recent delivery rate in bytes/sec
+	BytesAcked    uint64        // bytes sent and acknowledged by the peer
+	BytesReceived uint64        // bytes received from the peer
+}
+
+// TCPInfo returns the kernel TCP statistics for the underlying connection,
+// which must be a TCP connection possibly wrapped in other Conns or in a
+// type with a NetConn method like tls.Conn.
+// Returns ErrNoTCPInfo if not supported.
+func (c *Conn) TCPInfo() (info TCPInfo, err error) {
+	var rc syscall.RawConn
+	if rc, err = rawConn(c.Conn, ErrNoTCPInfo); err == nil {
+		info, err = tcpinfo(rc)
+	}
+	return
+}
+
+// rawConn returns the syscall.RawConn for the TCP connection underlying conn,
+// or unsupported if there is none.
+func rawConn(conn net.Conn, unsupported error) (syscall.RawConn, error) {
+	for {
+		switch v := conn.(type) {
+		case *Conn:
+			conn = v.Conn
+		case interface{ NetConn() net.Conn }:
+			conn = v.NetConn()
+		case syscall.Conn:
+			if _, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+				return v.SyscallConn()
+			}
+			return nil, unsupported
+		default:
+			return nil, unsupported
+		}
+	}
+}
@@ -0,0 +1,53 @@
+//go:build linux && !386
+
+package bwlimit
+
+import (
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// rawTCPInfo mirrors the start of the Linux kernel's struct tcp_info.
+type rawTCPInfo struct {
+	State, CAState, Retransmits, Probes, Backoff, Options, Wscale, Flags uint8
+
+	RTO, ATO, SndMSS, RcvMSS                                       uint32
+	Unacked, Sacked, Lost, Retrans, Fackets                        uint32
+	LastDataSent, LastAckSent, LastDataRecv, LastAckRecv           uint32
+	PMTU, RcvSsthresh, RTT, RTTVar, SndSsthresh, SndCwnd           uint32
+	AdvMSS, Reordering, RcvRTT, RcvSpace, TotalRetrans             uint32
+	PacingRate, MaxPacingRate, BytesAcked, BytesReceived           uint64
+	SegsOut, SegsIn, NotsentBytes, MinRTT, DataSegsIn, DataSegsOut uint32
+	DeliveryRate                                                   uint64
+}
+
+func tcpinfo(rc syscall.RawConn) (info TCPInfo, err error) {
+	var raw rawTCPInfo
+	var errno syscall.Errno
+	if err = rc.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(raw))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&raw)), uintptr(unsafe.Pointer(&size)), 0)
+	}); err == nil {
+		if errno != 0 {
+			err = errno
+		} else {
+			info = TCPInfo{
+				RTT:           time.Duration(raw.RTT) * time.Microsecond,
+				RTTVar:        time.Duration(raw.RTTVar) * time.Microsecond,
+				MinRTT:        time.Duration(raw.MinRTT) * time.Microsecond,
+				SndMSS:        raw.SndMSS,
+				SndCwnd:       raw.SndCwnd,
+				Retransmits:   raw.TotalRetrans,
+				Lost:          raw.Lost,
+				PacingRate:    raw.PacingRate,
+				MaxPacingRate: raw.MaxPacingRate,
+				DeliveryRate:  raw.DeliveryRate,
+				BytesAcked:    raw.BytesAcked,
+				BytesReceived: raw.BytesReceived,
+			}
+		}
+	}
+	return
+}
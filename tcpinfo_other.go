@@ -0,0 +1,9 @@
+//go:build !linux || 386
+
+package bwlimit
+
+import "syscall"
+
+func tcpinfo(rc syscall.RawConn) (info TCPInfo, err error) {
+	return info, ErrNoTCPInfo
+}
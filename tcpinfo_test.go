@@ -0,0 +1,66 @@
+package bwlimit
+
+import (
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+)
+
+func TestConn_TCPInfo(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}
+	}()
+
+	l := NewLimiter()
+	defer l.Stop()
+	conn, err := l.Wrap(l.Wrap(nil)).DialContext(t.Context(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write(make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := conn.(*Conn).TCPInfo()
+	if runtime.GOOS != "linux" {
+		if !errors.Is(err, ErrNoTCPInfo) {
+			t.Error(err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.RTT <= 0 || info.SndCwnd == 0 || info.BytesAcked < 1000 || info.BytesReceived != 1000 {
+		t.Errorf("%+v", info)
+	}
+	if stats := conn.(*Conn).Stats(); stats.TCP.BytesReceived != 1000 {
+		t.Errorf("%+v", stats.TCP)
+	}
+}
+
+func TestConn_TCPInfo_notTCP(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	l := NewLimiter()
+	defer l.Stop()
+	conn := NewConn(c1, l)
+	defer conn.Close()
+	if _, err := conn.TCPInfo(); !errors.Is(err, ErrNoTCPInfo) || !errors.Is(err, errors.ErrUnsupported) {
+		t.Error(err)
+	}
+}
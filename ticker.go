@@ -1,29 +1,44 @@
 package bwlimit
 
 import (
+	"context"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // A Ticker synchronizes rate calculation among multiple Limiters.
 // Ticker values must be created with NewTicker; the zero value is not supported.
+//
+// A Ticker runs a single goroutine regardless of how many Limiters use it.
+// The goroutine is started on first use and parks itself when no Operation
+// has seen traffic during the last second and nobody is waiting on WaitCh,
+// so an unused Ticker costs nothing.
 type Ticker struct {
-	mu     sync.Mutex
-	ch     chan struct{}
-	stopCh chan struct{}
+	tick   atomic.Int64 // incremented at the start of each time slice
+	ch     atomic.Pointer[chan struct{}]
+	waited atomic.Bool // set when WaitCh is called
+	parked atomic.Bool // set when the goroutine is not running
 	doneCh chan struct{}
+	mu     sync.Mutex // protects following
+	stopCh chan struct{}
+	opsMu  sync.Mutex // protects following
+	ops    map[*Operation]struct{}
 }
 
 var DefaultTicker *Ticker = NewTicker()
 
-// NewTicker creates and starts a Ticker.
+// NewTicker creates a Ticker. It's goroutine is started when first needed.
 func NewTicker() (ot *Ticker) {
+	ch := make(chan struct{})
 	ot = &Ticker{
-		ch:     make(chan struct{}),
 		stopCh: make(chan struct{}),
 		doneCh: make(chan struct{}),
+		ops:    make(map[*Operation]struct{}),
 	}
-	go ot.run(ot.stopCh)
+	ot.ch.Store(&ch)
+	ot.parked.Store(true)
 	return
 }
 
@@ -33,21 +48,69 @@ func (ot *Ticker) Stop() {
 	if ch := ot.stopCh; ch != nil {
 		ot.stopCh = nil
 		close(ch)
+		if ot.parked.Load() {
+			close(*ot.ch.Load())
+			close(ot.doneCh)
+		}
 	}
 	ot.mu.Unlock()
 	<-ot.doneCh
 }
 
+// wake starts the Ticker goroutine if it is parked.
+func (ot *Ticker) wake() {
+	if ot.parked.Load() {
+		ot.mu.Lock()
+		if ot.parked.Load() && ot.stopCh != nil {
+			// Start a new time slice, so that no budget
+			// from before we parked is reused.
+			ot.parked.Store(false)
+			ot.tick.Add(1)
+			go ot.run(ot.stopCh)
+		}
+		ot.mu.Unlock()
+	}
+}
+
+// park parks the Ticker if it wasn't needed during the last time slice.
+func (ot *Ticker) park() (parked bool) {
+	if !ot.waited.Swap(false) && ot.idle() {
+		ot.mu.Lock()
+		if ot.stopCh != nil {
+			// Recheck after setting parked, since track and WaitCh
+			// check parked after making themselves known.
+			ot.parked.Store(true)
+			if parked = !ot.waited.Load() && ot.idle(); !parked {
+				ot.parked.Store(false)
+			}
+		}
+		ot.mu.Unlock()
+	}
+	return
+}
+
+// idle returns true if no Operations are tracked.
+func (ot *Ticker) idle() bool {
+	ot.opsMu.Lock()
+	defer ot.opsMu.Unlock()
+	return len(ot.ops) == 0
+}
+
 // NewLimiter returns a new Limiter using this Ticker. If this Ticker is stopped,
 // returns nil.
 //
 // If you provide limits, the first will set
-// both read and write limits, the second will set the write limit.
+// both read and write limits, the second will set the write limit
+// and the third will set a combined limit shared by reads and writes.
 // Limits are applied in 100ms slices with fractional carry-over between
 // slices, so very low rates are accurate over time but can be bursty
 // at slice boundaries.
 //
-// To stop the limiter and free it's resources, call Stop.
+// To stop the limiter and free it's resources, call Stop. A Limiter that
+// becomes unreachable, together with all it's Conns, is stopped automatically.
+// That stops it's Operations too, so keep the Limiter reachable for as long as
+// they are used on their own, such as by a Controller or for WaitN, AllowN or
+// Reserve, or they will behave as if stopped.
 func (ot *Ticker) NewLimiter(limits ...int64) (l *Limiter) {
 	ot.mu.Lock()
 	if ot.stopCh != nil {
@@ -55,40 +118,104 @@ func (ot *Ticker) NewLimiter(limits ...int64) (l *Limiter) {
 			Ticker: ot,
 			Reads:  NewOperation(ot, limits, 0),
 			Writes: NewOperation(ot, limits, 1),
+			Total:  NewOperation(ot, nil, 2),
+		}
+		if len(limits) > 2 {
+			l.Total.Limit.Store(limits[2])
 		}
+		l.Reads.parent = l.Total
+		l.Writes.parent = l.Total
+		runtime.AddCleanup(l, stopOperations, []*Operation{l.Reads, l.Writes, l.Total})
 	}
 	ot.mu.Unlock()
 	return
 }
 
+// NewLimiterContext is like NewLimiter, but the Limiter is
+// stopped when ctx is done.
+func (ot *Ticker) NewLimiterContext(ctx context.Context, limits ...int64) (l *Limiter) {
+	if l = ot.NewLimiter(limits...); l != nil {
+		context.AfterFunc(ctx, l.Stop)
+	}
+	return
+}
+
+func stopOperations(ops []*Operation) {
+	for _, op := range ops {
+		op.Stop()
+	}
+}
+
 // WaitCh returns a channel that will close when the current rate limit
 // time slice runs out.
 func (ot *Ticker) WaitCh() (ch <-chan struct{}) {
-	ot.mu.Lock()
-	ch = ot.ch
-	ot.mu.Unlock()
+	// Load the channel before setting waited, so that a park consuming
+	// an earlier waited can't leave us with a channel that never closes.
+	// Either park sees waited and keeps running, or it set parked before
+	// checking waited, so wake sees parked and starts it again.
+	ch = *ot.ch.Load()
+	if !ot.waited.Load() {
+		ot.waited.Store(true)
+	}
+	ot.wake()
 	return
 }
 
-func (ot *Ticker) run(stopCh chan struct{}) {
-	defer func() {
-		close(ot.ch)
-		close(ot.doneCh)
-	}()
+// track makes the Ticker update the metrics for op each time slice.
+func (ot *Ticker) track(op *Operation) {
+	ot.opsMu.Lock()
+	select {
+	case <-op.doneCh:
+	default:
+		ot.ops[op] = struct{}{}
+	}
+	ot.opsMu.Unlock()
+	ot.wake()
+}
 
+// untrack stops the Ticker from updating the metrics for op.
+func (ot *Ticker) untrack(op *Operation) {
+	ot.opsMu.Lock()
+	defer ot.opsMu.Unlock()
+	delete(ot.ops, op)
+}
+
+// update updates the metrics for all Operations that have seen
+// traffic during the last second, and stops tracking the rest.
+func (ot *Ticker) update() {
+	ot.opsMu.Lock()
+	defer ot.opsMu.Unlock()
+	for op := range ot.ops {
+		if !op.update() {
+			delete(ot.ops, op)
+			op.active.Store(false)
+			if op.count.Load() != 0 && !op.active.Swap(true) {
+				// raced with Operation.account
+				ot.ops[op] = struct{}{}
+			}
+		}
+	}
+}
+
+func (ot *Ticker) run(stopCh chan struct{}) {
 	tckr := time.NewTicker(interval)
 	defer tckr.Stop()
 
 	for {
 		select {
 		case <-tckr.C:
+			ot.update()
+			// Advance tick before publishing the new channel, so that anyone
+			// waiting on the new channel is guaranteed to see the new tick.
 			newCh := make(chan struct{})
-			ot.mu.Lock()
-			oldCh := ot.ch
-			ot.ch = newCh
-			ot.mu.Unlock()
-			close(oldCh)
+			ot.tick.Add(1)
+			close(*ot.ch.Swap(&newCh))
+			if ot.park() {
+				return
+			}
 		case <-stopCh:
+			close(*ot.ch.Load())
+			close(ot.doneCh)
 			return
 		}
 	}
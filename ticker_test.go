@@ -3,6 +3,7 @@ package bwlimit
 import (
 	"bytes"
 	"io"
+	"runtime"
 	"sync"
 	"testing"
 	"testing/synctest"
@@ -30,6 +31,58 @@ func TestTicker_NewTicker_NewLimiter(t *testing.T) {
 	})
 }
 
+func TestTicker_parks(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		before := runtime.NumGoroutine()
+		ticker := NewTicker()
+		defer ticker.Stop()
+		l := ticker.NewLimiter(100)
+		defer l.Stop()
+		if after := runtime.NumGoroutine(); after > before || !ticker.parked.Load() {
+			t.Fatal("unused Ticker started", after-before)
+		}
+
+		// Limited reads wake the Ticker when they need to wait.
+		n, err := l.Reads.io(bytes.NewReader(make([]byte, 20)).Read, make([]byte, 20))
+		if n != 20 || err != nil {
+			t.Fatal(n, err)
+		}
+		if ticker.parked.Load() {
+			t.Fatal("Ticker parked while in use")
+		}
+
+		// Rate is updated while there is recent traffic.
+		<-ticker.WaitCh()
+		synctest.Wait()
+		if rate := l.Reads.Rate.Load(); rate != 20 {
+			t.Error(rate)
+		}
+
+		// After a second without traffic, it parks again.
+		time.Sleep(2 * time.Second)
+		synctest.Wait()
+		if !ticker.parked.Load() {
+			t.Fatal("idle Ticker did not park")
+		}
+		if rate := l.Reads.Rate.Load(); rate != 0 {
+			t.Error(rate)
+		}
+		if after := runtime.NumGoroutine(); after > before {
+			t.Error(after - before)
+		}
+
+		// Parked Tickers resume transparently.
+		now := time.Now()
+		n, err = l.Reads.io(bytes.NewReader(make([]byte, 20)).Read, make([]byte, 20))
+		if n != 20 || err != nil {
+			t.Fatal(n, err)
+		}
+		if elapsed := time.Since(now); elapsed != interval {
+			t.Error(elapsed)
+		}
+	})
+}
+
 func TestTicker_Stop_unblocksLimitedOperation(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		ticker := NewTicker()
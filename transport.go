@@ -0,0 +1,107 @@
+package bwlimit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// Transport returns a clone of base with it's connections bandwidth limited
+// by l. If base is nil, http.DefaultTransport is used.
+//
+// Connections are dialed through the Dialer returned by Wrap, so the limits
+// apply to all bytes sent and received, including TLS, HTTP/2 and connections
+// tunneled through proxies using CONNECT.
+//
+// If base has a DialTLSContext or DialTLS hook, the connections it returns
+// are wrapped instead, so TLS overhead on them is not counted. Since
+// http.Transport only uses HTTP/2 on a *tls.Conn, HTTP/2 is then disabled,
+// and dials where the hook negotiates HTTP/2 using ALPN fail.
+func (l *Limiter) Transport(base *http.Transport) (tp *http.Transport) {
+	if base == nil {
+		base = http.DefaultTransport.(*http.Transport)
+	}
+	tp = base.Clone()
+	// Setting DialContext would otherwise disable HTTP/2 if it was enabled by default.
+	tp.ForceAttemptHTTP2 = tp.ForceAttemptHTTP2 || (tp.TLSClientConfig == nil &&
+		tp.Dial == nil && tp.DialContext == nil && tp.DialTLS == nil && tp.DialTLSContext == nil)
+
+	var cd ContextDialer
+	if dial := tp.Dial; dial != nil {
+		cd = dialFunc(func(ctx context.Context, network, address string) (net.Conn, error) {
+			return dial(network, address)
+		})
+	}
+	if tp.DialContext != nil {
+		cd = dialFunc(tp.DialContext)
+	}
+	tp.DialContext = l.Wrap(cd).DialContext
+	tp.Dial = nil
+
+	dialTLS := tp.DialTLSContext
+	if f := tp.DialTLS; dialTLS == nil && f != nil {
+		dialTLS = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return f(network, address)
+		}
+	}
+	if dialTLS != nil {
+		tp.ForceAttemptHTTP2 = false
+		tp.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		if cfg := tp.TLSClientConfig; cfg != nil {
+			cfg.NextProtos = slices.DeleteFunc(slices.Clone(cfg.NextProtos), func(proto string) bool { return proto == "h2" })
+		}
+		tp.DialTLSContext = func(ctx context.Context, network, address string) (conn net.Conn, err error) {
+			if conn, err = dialTLS(ctx, network, address); err == nil {
+				if conn, err = newTLSConn(ctx, conn, l); err != nil {
+					_ = conn.Close()
+					conn = nil
+				}
+			}
+			return
+		}
+	}
+	tp.DialTLS = nil
+	return
+}
+
+// HTTPClient returns an http.Client using l.Transport(nil).
+func (l *Limiter) HTTPClient() *http.Client {
+	return &http.Client{Transport: l.Transport(nil)}
+}
+
+// A tlsConn is a Conn wrapping a TLS connection. It exposes the
+// ConnectionState so that http.Transport can use HTTP/2 with it.
+type tlsConn struct {
+	*Conn
+	cs interface{ ConnectionState() tls.ConnectionState }
+}
+
+// ErrHTTP2 is returned when a custom TLS dialer used with Limiter.Transport
+// negotiates HTTP/2, which can't be used on the wrapped connection.
+var ErrHTTP2 = errors.New("bwlimit: custom TLS dialer negotiated HTTP/2")
+
+// newTLSConn returns conn wrapped in a Conn limited by l, keeping
+// the ConnectionState method if conn has one. If conn can handshake,
+// it is done first, since http.Transport won't do it for the wrapped conn.
+func newTLSConn(ctx context.Context, conn net.Conn, l *Limiter) (net.Conn, error) {
+	if hs, ok := conn.(interface{ HandshakeContext(context.Context) error }); ok {
+		if err := hs.HandshakeContext(ctx); err != nil {
+			return conn, err
+		}
+	}
+	c := NewConn(conn, l)
+	if cs, ok := conn.(interface{ ConnectionState() tls.ConnectionState }); ok {
+		if cs.ConnectionState().NegotiatedProtocol == "h2" {
+			return c, ErrHTTP2
+		}
+		return &tlsConn{Conn: c, cs: cs}, nil
+	}
+	return c, nil
+}
+
+func (c *tlsConn) ConnectionState() tls.ConnectionState {
+	return c.cs.ConnectionState()
+}
@@ -0,0 +1,165 @@
+package bwlimit
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var hello = strings.Repeat("Hello world! ", 100)
+
+func newTLSServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, hello)
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// get fetches url using client and returns the HTTP major version.
+func get(t *testing.T, client *http.Client, url string) int {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, err := io.ReadAll(resp.Body); string(b) != hello || err != nil {
+		t.Error(len(b), err)
+	}
+	return resp.ProtoMajor
+}
+
+func TestLimiter_Transport(t *testing.T) {
+	srv := newTLSServer(t)
+	l := NewLimiter()
+	defer l.Stop()
+
+	tp := l.Transport(srv.Client().Transport.(*http.Transport))
+	defer tp.CloseIdleConnections()
+	if proto := get(t, &http.Client{Transport: tp}, srv.URL); proto != 2 {
+		t.Error(proto)
+	}
+	// TLS and HTTP/2 overhead is counted too.
+	if n := l.Reads.count.Load() + l.Reads.Count.Load(); n <= int64(len(hello)) {
+		t.Error(n)
+	}
+	if l.Writes.count.Load()+l.Writes.Count.Load() == 0 {
+		t.Error("writes not counted")
+	}
+}
+
+func TestLimiter_Transport_DialTLSContext(t *testing.T) {
+	srv := newTLSServer(t)
+	l := NewLimiter()
+	defer l.Stop()
+
+	base := srv.Client().Transport.(*http.Transport).Clone()
+	cfg := base.TLSClientConfig.Clone()
+	base.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := tls.Dialer{Config: cfg}
+		return d.DialContext(ctx, network, addr)
+	}
+	tp := l.Transport(base)
+	defer tp.CloseIdleConnections()
+
+	// HTTP/2 can't be used on the wrapped connection.
+	if slices.Contains(tp.TLSClientConfig.NextProtos, "h2") {
+		t.Error(tp.TLSClientConfig.NextProtos)
+	}
+	cfg.NextProtos = []string{"h2", "http/1.1"}
+	if _, err := (&http.Client{Transport: tp}).Get(srv.URL); !errors.Is(err, ErrHTTP2) {
+		t.Error(err)
+	}
+
+	cfg.NextProtos = []string{"http/1.1"}
+	if proto := get(t, &http.Client{Transport: tp}, srv.URL); proto != 1 {
+		t.Error(proto)
+	}
+	if n := l.Reads.count.Load() + l.Reads.Count.Load(); n < int64(len(hello)) {
+		t.Error(n)
+	}
+}
+
+func TestLimiter_Transport_proxy(t *testing.T) {
+	srv := newTLSServer(t)
+	l := NewLimiter()
+	defer l.Stop()
+
+	var mu sync.Mutex
+	var tunneled []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		mu.Lock()
+		tunneled = append(tunneled, r.Host)
+		mu.Unlock()
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer upstream.Close()
+		w.WriteHeader(http.StatusOK)
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		go func() {
+			_, _ = io.Copy(upstream, brw)
+		}()
+		_, _ = io.Copy(conn, upstream)
+	}))
+	defer proxy.Close()
+
+	base := srv.Client().Transport.(*http.Transport).Clone()
+	proxyURL, _ := url.Parse(proxy.URL)
+	base.Proxy = http.ProxyURL(proxyURL)
+	tp := l.Transport(base)
+	defer tp.CloseIdleConnections()
+	get(t, &http.Client{Transport: tp}, srv.URL)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(tunneled) != 1 {
+		t.Error(tunneled)
+	}
+	if n := l.Reads.count.Load() + l.Reads.Count.Load(); n <= int64(len(hello)) {
+		t.Error(n)
+	}
+}
+
+func TestLimiter_HTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, hello)
+	}))
+	defer srv.Close()
+	l := NewLimiter()
+	defer l.Stop()
+
+	client := l.HTTPClient()
+	defer client.CloseIdleConnections()
+	tp := client.Transport.(*http.Transport)
+	if !tp.ForceAttemptHTTP2 || tp.DialContext == nil {
+		t.Error(tp.ForceAttemptHTTP2)
+	}
+	get(t, client, srv.URL)
+	if n := l.Reads.count.Load() + l.Reads.Count.Load(); n <= int64(len(hello)) {
+		t.Error(n)
+	}
+}